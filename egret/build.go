@@ -22,6 +22,11 @@ apply and may be used to determine logic in the application itself.
 
 Run mode defaults to "dev".
 
+The build.hooks.pre and build.hooks.post commands of app.yaml run before and
+after "go build", as they do on each rebuild of "egret run".  The asset
+bundles set by assets.bundles are built after the pre-build hooks, and copied
+along with the app.
+
 WARNING: The target path will be completely deleted, if it already exists!
 
 For example:
@@ -55,14 +60,16 @@ func buildApp(args []string) {
 		errorf("Abort: %s exists and does not look like a build directory.", destPath)
 	}
 
+	// Built first, so that the sources generated by the hooks and the asset
+	// bundles are copied along with the app.
+	app, eerr := harness.Build(logger)
+	panicOnError(eerr, "Failed to build")
+
 	os.RemoveAll(destPath)
 	srcPath := path.Join(destPath, "src")
 	mustCopyDir(path.Join(srcPath, filepath.FromSlash(appImportPath)), egret.BasePath, false, nil)
 	os.MkdirAll(destPath, 0777)
 
-	app, eerr := harness.Build(logger)
-	panicOnError(eerr, "Failed to build")
-
 	// Included are:
 	// - run scripts
 	// - binary
@@ -1,6 +1,7 @@
 package main
 
 import (
+	"flag"
 	"strconv"
 
 	"github.com/kenorld/egret-cmd/harness"
@@ -9,7 +10,7 @@ import (
 )
 
 var cmdRun = &Command{
-	UsageLine: "run [import path] [run mode] [port]",
+	UsageLine: "run [-workspace file] [-debug [-debug-port port]] [-race] [-msan] [-asan] [-log-level level] [-port port|auto] [import path] [run mode] [port]",
 	Short:     "run a Egret application",
 	Long: `
 Run the Egret web application named by the given import path.
@@ -25,7 +26,39 @@ Run mode defaults to "dev".
 
 You can set a port as an optional third parameter.  For example:
 
-    egret run github.com/kenorld/egret-samples/chat prod 8080`,
+    egret run github.com/kenorld/egret-samples/chat prod 8080
+
+or with -port.  If the port is taken, egret stops before building and names
+the process holding it.  With "auto", the first free port from the configured
+one is used instead:
+
+    egret run -port auto github.com/kenorld/egret-samples/chat
+
+With -workspace, the apps listed in the given YAML file are run together,
+each rebuilt on its own, behind a single proxy routing requests to them by
+host and path prefix:
+
+    egret run -workspace egret.workspace.yaml
+
+With -debug, the app is built without optimizations and run under a headless
+Delve session that IDEs can attach to, on -debug-port (harness.debug.port,
+2345 by default).  The session is started again after each rebuild:
+
+    egret run -debug github.com/kenorld/egret-samples/chat
+
+With -race, -msan or -asan, the app is built with the race detector, the
+memory or the address sanitizer.  Their reports are shown as warnings on the
+harness dashboard (/@harness/), and on the error page if the app crashes.
+
+JSON log lines of the app are shown prettified, without those below
+-log-level (harness.log.level).
+
+The asset bundles set by assets.bundles in app.yaml are built before the app
+starts, and built again when their sources under public/ change.
+
+The path prefixes set by harness.proxy.routes are forwarded to other upstreams,
+or answered from stub files, so that the harness serves the app along with
+the services it depends on.`,
 }
 
 func init() {
@@ -33,8 +66,28 @@ func init() {
 }
 
 func runApp(args []string) {
+	fs := flag.NewFlagSet("run", flag.ContinueOnError)
+	workspace := fs.String("workspace", "", "run the apps listed in the given workspace file")
+	debug := fs.Bool("debug", false, "run the app under a headless Delve session")
+	debugPort := fs.Int("debug-port", 0, "port of the Delve session (default harness.debug.port or 2345)")
+	build := addBuildFlags(fs)
+	portFlag := fs.String("port", "", "port to listen on, or \"auto\" for the first free one from the configured port")
+	logLevel := fs.String("log-level", "", "hide the app's structured logs below this level (default harness.log.level)")
+	args = parseFlags(fs, args)
+	harness.LogLevel = *logLevel
+
+	if *workspace != "" {
+		ws, err := harness.LoadWorkspace(*workspace, logger)
+		if err != nil {
+			errorf("Failed to load workspace: %s", err)
+		}
+		ws.BuildFlags = build.flags()
+		ws.Debug, ws.DebugPort = *debug, *debugPort
+		ws.Run() // Never returns.
+	}
+
 	if len(args) == 0 {
-		args[0] = ""
+		args = append(args, "")
 	}
 	if args[0] == "." || args[0] == "./" {
 		args[0] = ""
@@ -51,11 +104,24 @@ func runApp(args []string) {
 	egret.LoadMimeConfig()
 
 	// Determine the override port, if any.
-	port := egret.HttpPort
+	port, portArg := egret.HttpPort, *portFlag
 	if len(args) == 3 {
+		portArg = args[2]
+	}
+	switch portArg {
+	case "":
+	case "auto":
+		var err error
+		if port, err = harness.NextFreePort(egret.HttpAddr, egret.HttpPort); err != nil {
+			errorf("Failed to find a free port: %s", err)
+		}
+		if port != egret.HttpPort {
+			logger.Info("Port in use, picked the next free one", zap.Int("configured", egret.HttpPort), zap.Int("port", port))
+		}
+	default:
 		var err error
-		if port, err = strconv.Atoi(args[2]); err != nil {
-			errorf("Failed to parse port as integer: %s", args[2])
+		if port, err = strconv.Atoi(portArg); err != nil {
+			errorf("Failed to parse port as integer: %s", portArg)
 		}
 	}
 
@@ -66,20 +132,44 @@ func runApp(args []string) {
 		zap.String("base_path", egret.BasePath),
 	)
 
+	var delve *harness.Delve
+	if *debug {
+		var err error
+		if delve, err = harness.NewDelve(*debugPort); err != nil {
+			errorf("Failed to set up the debugger: %s", err)
+		}
+		logger.Info("Debugger enabled, attach to " + delve.Addr)
+	}
+
 	// If the app is run in "watched" mode, use the harness to run it.
 	if egret.Config.GetBoolDefault("watch.enabled", true) && egret.Config.GetBoolDefault("watch.code", true) {
 		logger.Info("Running in watched mode.")
-		egret.HttpPort = port
-		harness.NewHarness(logger).Run() // Never returns.
+		// An explicit port is kept when the configuration is reloaded.
+		httpPort := 0
+		if portArg != "" {
+			httpPort = port
+		}
+		h := harness.NewHarness(logger, httpPort)
+		h.Debug = delve
+		h.BuildFlags = build.flags()
+		h.Run() // Never returns.
 	}
 
 	// Else, just build and run the app.
 	logger.Info("Running in live build mode.")
-	app, err := harness.Build(logger)
+	if err := harness.CheckPort(egret.HttpAddr, port); err != nil {
+		errorf("Cannot listen: %s; stop it, or pick another port (-port auto for the next free one)", err)
+	}
+	flags := build.flags()
+	if delve != nil {
+		flags = append(flags, harness.DebugBuildFlags...)
+	}
+	app, err := harness.Build(logger, flags...)
 	if err != nil {
 		errorf("Failed to build app: %s", err)
 	}
 	app.Port = port
+	app.Debug = delve
 
 	app.Cmd().Run()
 }
@@ -1,6 +1,7 @@
 package main
 
 import (
+	"flag"
 	"fmt"
 	"io"
 	"io/ioutil"
@@ -16,7 +17,7 @@ import (
 )
 
 var cmdTest = &Command{
-	UsageLine: "test [import path] [run mode] [suite.method]",
+	UsageLine: "test [-race] [-msan] [-asan] [import path] [run mode] [suite.method]",
 	Short:     "run all tests from the command-line",
 	Long: `
 Run all tests for the Egret app named by the given import path.
@@ -38,6 +39,9 @@ For example, to run all of UserTest:
 or one of UserTest's methods:
 
     egret test outspoken test UserTest.Test1
+
+With -race, -msan or -asan, the app is built with the race detector, the
+memory or the address sanitizer, and the tests fail on any of their reports.
 `,
 }
 
@@ -46,9 +50,13 @@ func init() {
 }
 
 func testApp(args []string) {
+	fs := flag.NewFlagSet("test", flag.ContinueOnError)
+	build := addBuildFlags(fs)
+	args = parseFlags(fs, args)
+
 	var err error
 	if len(args) == 0 {
-		args[0] = ""
+		args = append(args, "")
 	}
 	if args[0] == "." || args[0] == "./" {
 		args[0] = ""
@@ -95,13 +103,14 @@ func testApp(args []string) {
 		errorf("Failed to create log file: %s", err)
 	}
 
-	app, reverr := harness.Build(logger)
+	app, reverr := harness.Build(logger, build.flags()...)
 	if reverr != nil {
 		errorf("Error building: %s", reverr)
 	}
+	app.Port = egret.HttpPort
 	cmd := app.Cmd()
 	cmd.Stderr = io.MultiWriter(cmd.Stderr, file)
-	cmd.Stdout = io.MultiWriter(cmd.Stderr, file)
+	cmd.Stdout = io.MultiWriter(cmd.Stdout, file)
 
 	// Start the app...
 	if err := cmd.Start(); err != nil {
@@ -228,6 +237,18 @@ func testApp(args []string) {
 	// 	writeResultFile(resultPath, "result.failed", "failed")
 	// 	errorf("Some tests failed.  See file://%s for results.", resultPath)
 	// }
+
+	// Fail on anything the race detector or sanitizers reported, including
+	// at exit: stop the app first, Kill waits for its output.
+	cmd.Kill()
+	if reports := cmd.SanitizerReports(); len(reports) > 0 {
+		fmt.Printf("\n%d race detector / sanitizer report%s:\n\n", len(reports), pluralize(len(reports), "", "s"))
+		for _, report := range reports {
+			fmt.Printf("%s: %s\n%s\n\n", report.Kind, report.Summary, report.Text)
+		}
+		writeResultFile(resultPath, "result.failed", "failed")
+		errorf("The race detector or sanitizers reported problems.  See file://%s for the app log.", resultPath)
+	}
 }
 
 func writeResultFile(resultPath, name, content string) {
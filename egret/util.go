@@ -3,6 +3,7 @@ package main
 import (
 	"archive/tar"
 	"compress/gzip"
+	"flag"
 	"fmt"
 	"io"
 	"os"
@@ -152,3 +153,48 @@ func empty(dirname string) bool {
 	results, _ := dir.Readdir(1)
 	return len(results) == 0
 }
+
+// parseFlags parses the flags defined in fs wherever they appear in args,
+// before or after the positional arguments, which are returned.
+func parseFlags(fs *flag.FlagSet, args []string) []string {
+	var positional []string
+	for {
+		if err := fs.Parse(args); err != nil {
+			errorf("%s", err)
+		}
+		args = fs.Args()
+		if len(args) == 0 {
+			return positional
+		}
+		positional = append(positional, args[0])
+		args = args[1:]
+	}
+}
+
+// buildOptions are the flags of run and test selecting how the app is built.
+type buildOptions struct {
+	race, msan, asan *bool
+}
+
+func addBuildFlags(fs *flag.FlagSet) *buildOptions {
+	return &buildOptions{
+		race: fs.Bool("race", false, "build the app with the race detector"),
+		msan: fs.Bool("msan", false, "build the app with the memory sanitizer"),
+		asan: fs.Bool("asan", false, "build the app with the address sanitizer"),
+	}
+}
+
+// flags returns the "go build" flags selected.
+func (o *buildOptions) flags() []string {
+	var flags []string
+	if *o.race {
+		flags = append(flags, "-race")
+	}
+	if *o.msan {
+		flags = append(flags, "-msan")
+	}
+	if *o.asan {
+		flags = append(flags, "-asan")
+	}
+	return flags
+}
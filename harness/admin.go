@@ -0,0 +1,296 @@
+package harness
+
+import (
+	"encoding/json"
+	"html/template"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/kenorld/egret-core"
+)
+
+// adminPath prefixes the routes reserved by the harness.
+const adminPath = "/@harness"
+
+// isAdminPath reports whether p is one of the routes reserved by the harness.
+func isAdminPath(p string) bool {
+	return p == adminPath || strings.HasPrefix(p, adminPath+"/")
+}
+
+// harnessStatus is the JSON document served by /@harness/status.
+type harnessStatus struct {
+	State         string         `json:"state"` // building, running, failed or stopped
+	Building      bool           `json:"building"`
+	LastBuild     *buildStatus   `json:"lastBuild,omitempty"`
+	Error         *errorStatus   `json:"error,omitempty"`
+	CompileErrors []CompileError `json:"compileErrors,omitempty"`
+	Warnings      []errorStatus  `json:"warnings,omitempty"` // errors the app keeps serving despite
+	App           *appStatus     `json:"app,omitempty"`
+	Crashes       int            `json:"crashes,omitempty"` // crashes in a row
+}
+
+type buildStatus struct {
+	Started    time.Time `json:"started"`
+	DurationMs int64     `json:"durationMs"`
+	Failed     bool      `json:"failed"`
+}
+
+type errorStatus struct {
+	Name    string `json:"name"`
+	Title   string `json:"title"`
+	Summary string `json:"summary"`
+	Path    string `json:"path,omitempty"`
+	Line    int    `json:"line,omitempty"`
+}
+
+type appStatus struct {
+	Pid           int       `json:"pid"`
+	Port          int       `json:"port"`
+	Binary        string    `json:"binary"`
+	Started       time.Time `json:"started"`
+	UptimeSeconds int64     `json:"uptimeSeconds"`
+	Debugger      string    `json:"debugger,omitempty"`
+}
+
+// adminHandler returns the handler of the reserved harness routes:
+//
+//	/@harness/                 dashboard
+//	/@harness/status           build state, last build and app process, as JSON
+//	/@harness/logs             tail of the app's stdout and stderr, as JSON
+//	/@harness/rebuild          POST to force a rebuild, bypassing the build cache
+//	/@harness/restart          POST to restart the app without rebuilding
+//	/@harness/livereload       live-reload event stream
+//	/@harness/requests         recent requests to the app
+//	/@harness/requests.har     recent requests to the app, as HAR
+//	/@harness/requests/replay  POST to replay a recorded request
+func (h *Harness) adminHandler() *http.ServeMux {
+	mux := http.NewServeMux()
+	mux.HandleFunc(adminPath+"/", h.serveDashboard)
+	mux.HandleFunc(adminPath+"/status", h.serveStatus)
+	mux.HandleFunc(adminPath+"/logs", h.serveLogs)
+	mux.HandleFunc(adminPath+"/rebuild", h.serveAction(actionRebuild))
+	mux.HandleFunc(adminPath+"/restart", h.serveAction(actionRestart))
+	if h.reload != nil {
+		mux.Handle(liveReloadPath, h.reload)
+	}
+	if h.inspector != nil {
+		mux.HandleFunc(adminPath+"/requests", h.serveRequests)
+		mux.HandleFunc(adminPath+"/requests.har", h.serveHAR)
+		mux.HandleFunc(adminPath+"/requests/replay", h.serveReplay)
+	}
+	return mux
+}
+
+// status returns a snapshot of what the harness is doing.
+func (h *Harness) status() harnessStatus {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	st := harnessStatus{
+		Building:      h.building,
+		CompileErrors: h.compileErrors,
+		Crashes:       h.crashes,
+	}
+	if !h.lastBuild.Started.IsZero() {
+		st.LastBuild = &buildStatus{
+			Started:    h.lastBuild.Started,
+			DurationMs: int64(h.lastBuild.Duration / time.Millisecond),
+			Failed:     h.lastBuild.Failed,
+		}
+	}
+	if err := h.lastError; err != nil {
+		st.Error = newErrorStatus(err)
+	}
+	sources := make([]string, 0, len(h.warnings))
+	for source := range h.warnings {
+		sources = append(sources, source)
+	}
+	sort.Strings(sources)
+	for _, source := range sources {
+		st.Warnings = append(st.Warnings, *newErrorStatus(h.warnings[source]))
+	}
+	if h.app != nil && h.app.cmd.Process != nil {
+		st.App = &appStatus{
+			Pid:           h.app.cmd.Process.Pid,
+			Port:          h.app.Port,
+			Binary:        h.app.BinaryPath,
+			Started:       h.app.started,
+			UptimeSeconds: int64(time.Since(h.app.started) / time.Second),
+		}
+		if h.app.Debug != nil {
+			st.App.Debugger = h.app.Debug.Addr
+		}
+	}
+
+	switch {
+	case h.building:
+		st.State = "building"
+	case h.lastError != nil:
+		st.State = "failed"
+	case h.app != nil:
+		st.State = "running"
+	default:
+		st.State = "stopped"
+	}
+	return st
+}
+
+func newErrorStatus(err *egret.Error) *errorStatus {
+	return &errorStatus{
+		Name:    err.Name,
+		Title:   err.Title,
+		Summary: err.Summary,
+		Path:    err.Path,
+		Line:    err.Line,
+	}
+}
+
+func (h *Harness) serveStatus(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, h.status())
+}
+
+func (h *Harness) serveLogs(w http.ResponseWriter, r *http.Request) {
+	h.mu.Lock()
+	app := h.app
+	h.mu.Unlock()
+
+	logs := struct {
+		Stdout string `json:"stdout"`
+		Stderr string `json:"stderr"`
+	}{}
+	if app != nil && app.cmd.Cmd != nil {
+		logs.Stdout = string(app.cmd.stdout.Bytes())
+		logs.Stderr = string(app.cmd.stderr.Bytes())
+	}
+	writeJSON(w, http.StatusOK, logs)
+}
+
+// serveAction queues the given action.  Only POST requests are accepted.
+func (h *Harness) serveAction(action int32) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if !checkPost(w, r) {
+			return
+		}
+		h.resetCrashes()
+		if action == actionRebuild {
+			atomic.StoreInt32(&h.forceBuild, 1)
+		}
+		h.schedule(action)
+		writeJSON(w, http.StatusAccepted, h.status())
+	}
+}
+
+// checkPost answers requests that are not POST requests from a page of the
+// harness or the app, so that other sites can't trigger actions, and reports
+// whether r is to be served.  Clients that are not browsers send neither
+// Origin nor Referer, and are trusted.
+func checkPost(w http.ResponseWriter, r *http.Request) bool {
+	if r.Method != "POST" {
+		w.Header().Set("Allow", "POST")
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return false
+	}
+	if site := r.Header.Get("Sec-Fetch-Site"); site != "" && site != "same-origin" && site != "none" {
+		http.Error(w, "Cross-origin request refused", http.StatusForbidden)
+		return false
+	}
+	origin := r.Header.Get("Origin")
+	if origin == "" {
+		origin = r.Referer()
+	}
+	if origin != "" {
+		if u, err := url.Parse(origin); err != nil || !strings.EqualFold(u.Host, r.Host) {
+			http.Error(w, "Cross-origin request refused", http.StatusForbidden)
+			return false
+		}
+	}
+	return true
+}
+
+func (h *Harness) serveDashboard(w http.ResponseWriter, r *http.Request) {
+	if r.URL.Path != adminPath+"/" {
+		http.NotFound(w, r)
+		return
+	}
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	dashboardTemplate.Execute(w, appName())
+}
+
+// appName returns the name of the app, which the configuration sets.
+func appName() string {
+	configMu.RLock()
+	defer configMu.RUnlock()
+	return egret.AppName
+}
+
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	w.WriteHeader(status)
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	enc.Encode(v)
+}
+
+var dashboardTemplate = template.Must(template.New("dashboard").Parse(`<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<title>{{.}} - Egret harness</title>
+<style>
+body { font-family: sans-serif; margin: 0; color: #333; }
+header { background: #2a6ebb; color: #fff; padding: 12px 16px; }
+header h1 { display: inline; font-size: 20px; margin: 0; }
+header button { margin-left: 8px; }
+section { padding: 8px 16px; }
+table td { padding: 2px 12px 2px 0; }
+pre { background: #f6f6f6; max-height: 300px; overflow: auto; padding: 8px; white-space: pre-wrap; }
+.state-running { color: #393; } .state-failed { color: #c33; } .state-building { color: #c93; }
+</style>
+</head>
+<body>
+<header>
+<h1>{{.}}</h1>
+<button onclick="post('rebuild')">Rebuild</button>
+<button onclick="post('restart')">Restart</button>
+<a href="/@harness/requests" style="color: #fff; margin-left: 12px">Requests</a>
+</header>
+<section>
+<table>
+<tr><td>State</td><td id="state"></td></tr>
+<tr><td>Last build</td><td id="build"></td></tr>
+<tr><td>Error</td><td id="error"></td></tr>
+<tr><td>Warnings</td><td id="warnings"></td></tr>
+<tr><td>PID</td><td id="pid"></td></tr>
+<tr><td>Uptime</td><td id="uptime"></td></tr>
+</table>
+</section>
+<section><h3>stdout</h3><pre id="stdout"></pre></section>
+<section><h3>stderr</h3><pre id="stderr"></pre></section>
+<script>
+function $(id) { return document.getElementById(id); }
+function post(action) { fetch("/@harness/" + action, {method: "POST"}).then(update); }
+function update() {
+	fetch("/@harness/status").then(function(r) { return r.json(); }).then(function(s) {
+		$("state").textContent = s.state;
+		$("state").className = "state-" + s.state;
+		$("build").textContent = s.lastBuild ? s.lastBuild.started + " (" + s.lastBuild.durationMs + " ms)" : "-";
+		$("error").textContent = s.error ? s.error.title + ": " + s.error.summary : "-";
+		$("warnings").textContent = s.warnings ? s.warnings.map(function(w) { return w.title + ": " + w.summary; }).join("\n") : "-";
+		$("pid").textContent = s.app ? s.app.pid + " (port " + s.app.port + (s.app.debugger ? ", debugger on " + s.app.debugger : "") + ")" : "-";
+		$("uptime").textContent = s.app ? s.app.uptimeSeconds + " s" : "-";
+	});
+	fetch("/@harness/logs").then(function(r) { return r.json(); }).then(function(l) {
+		$("stdout").textContent = l.stdout;
+		$("stderr").textContent = l.stderr;
+	});
+}
+update();
+setInterval(update, 2000);
+</script>
+</body>
+</html>
+`))
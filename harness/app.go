@@ -1,12 +1,18 @@
 package harness
 
 import (
-	"bytes"
 	"errors"
 	"fmt"
 	"io"
+	"net"
+	"net/http"
 	"os"
 	"os/exec"
+	"os/signal"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"syscall"
 	"time"
 
 	"github.com/kenorld/egret-core"
@@ -17,9 +23,14 @@ import (
 // App contains the configuration for running a Revel app.  (Not for the app itself)
 // Its only purpose is constructing the command to execute.
 type App struct {
-	BinaryPath string // Path to the app executable
-	Port       int    // Port to pass as a command line argument.
-	cmd        AppCmd // The last cmd returned.
+	BinaryPath string       // Path to the app executable
+	Port       int          // Port to pass as a command line argument.
+	Debug      *Delve       // Debugger to run the app under, if any.
+	hash       string       // hash of the sources the binary was built from, if known
+	buildDir   string       // directory of the build the binary is alone in, if any
+	reserved   net.Listener // holds Port until the app is started
+	cmd        AppCmd       // The last cmd returned.
+	started    time.Time
 	logger     *zap.Logger
 }
 
@@ -30,6 +41,10 @@ func NewApp(binPath string, logger *zap.Logger) *App {
 // Return a command to run the app server using the current configuration.
 func (a *App) Cmd() AppCmd {
 	a.cmd = NewAppCmd(a.BinaryPath, a.Port, a.logger)
+	a.cmd.reserved, a.reserved = a.reserved, nil
+	if a.Debug != nil {
+		a.Debug.wrap(&a.cmd)
+	}
 	return a.cmd
 }
 
@@ -38,11 +53,42 @@ func (a *App) Kill() {
 	a.cmd.Kill()
 }
 
+// removeBuild removes the binary, once no longer run, if it's alone in the
+// directory of its build.
+func (a *App) removeBuild() {
+	if a.buildDir == "" {
+		return
+	}
+	if err := os.RemoveAll(a.buildDir); err != nil {
+		a.logger.Warn("Failed to remove build", zap.String("dir", a.buildDir), zap.Error(err))
+	}
+}
+
 // AppCmd manages the running of a Revel app server.
 // It requires egret.Init to have been called previously.
 type AppCmd struct {
 	*exec.Cmd
+	port   int
 	logger *zap.Logger
+	exit   *appExit
+	stdout *tailBuffer // last output of the app on stdout
+	stderr *tailBuffer // last output of the app on stderr
+	debug  bool        // run under Delve
+
+	reserved net.Listener // holds port until the app is started
+
+	sanitizer *sanitizerScanner // race detector and sanitizer reports
+	stdoutLog *appLogWriter
+	stderrLog *appLogWriter
+}
+
+// appExit records the result of waiting for the app process.
+// It is shared by all copies of an AppCmd.
+type appExit struct {
+	once    sync.Once
+	done    chan struct{}
+	err     error
+	stopped int32 // set when the app is being killed by the harness
 }
 
 func NewAppCmd(binPath string, port int, logger *zap.Logger) AppCmd {
@@ -50,17 +96,61 @@ func NewAppCmd(binPath string, port int, logger *zap.Logger) AppCmd {
 		fmt.Sprintf("-port=%d", port),
 		fmt.Sprintf("-importPath=%s", egret.ImportPath),
 		fmt.Sprintf("-runMode=%s", egret.RunMode))
-	cmd.Stdout, cmd.Stderr = os.Stdout, os.Stderr
-	return AppCmd{cmd, logger}
+	tailSize := egret.Config.GetIntDefault("harness.tail.size", 64*1024)
+	stdout, stderr := newTailBuffer(tailSize), newTailBuffer(tailSize)
+	sanitizer := newSanitizerScanner()
+	stdoutLog, stderrLog := newAppLogWriter(os.Stdout, logger), newAppLogWriter(os.Stderr, logger)
+	outs, errs := []io.Writer{stdoutLog, stdout}, []io.Writer{stderrLog, stderr, sanitizer}
+	if f := appLogFile(logger); f != nil {
+		// The raw output goes to the log file.
+		outs, errs = append(outs, f), append(errs, f)
+	}
+	cmd.Stdout, cmd.Stderr = io.MultiWriter(outs...), io.MultiWriter(errs...)
+	cmd.Env = appEnv(logger)
+	setProcessGroup(cmd)
+	return AppCmd{
+		Cmd:       cmd,
+		port:      port,
+		logger:    logger,
+		exit:      &appExit{done: make(chan struct{})},
+		stdout:    stdout,
+		stderr:    stderr,
+		sanitizer: sanitizer,
+		stdoutLog: stdoutLog,
+		stderrLog: stderrLog,
+	}
 }
 
 // Start the app server, and wait until it is ready to serve requests.
+// Readiness is probed on the app's port, and on the harness.ready.path
+// HTTP endpoint if one is configured.  The app is killed if it isn't ready
+// within harness.startup.timeout (harness.ready.timeout, or 30s by default).
 func (cmd AppCmd) Start() error {
-	listeningWriter := startupListeningWriter{os.Stdout, make(chan bool)}
-	cmd.Stdout = listeningWriter
+	if cmd.reserved != nil {
+		// Free the port even if the app isn't started.
+		defer cmd.reserved.Close()
+	}
+	timeout, err := time.ParseDuration(egret.Config.GetStringDefault("harness.startup.timeout",
+		egret.Config.GetStringDefault("harness.ready.timeout", "30s")))
+	if err != nil {
+		return fmt.Errorf("egret/harness: invalid harness.startup.timeout: %s", err)
+	}
+
+	done := make(chan struct{})
+	defer close(done)
+	ready, err := waitReady(cmd.port, egret.Config.GetStringDefault("harness.ready.path", ""), done)
+	if err != nil {
+		return err
+	}
+
 	cmd.logger.Info("Exec app", zap.String("path", cmd.Path), zap.Strings("args", cmd.Args))
+	if cmd.reserved != nil {
+		// Free the port for the app to bind, as late as possible.
+		cmd.reserved.Close()
+	}
 	if err := cmd.Cmd.Start(); err != nil {
 		cmd.logger.Error("Error running", zap.Error(err))
+		return err
 	}
 
 	select {
@@ -68,58 +158,178 @@ func (cmd AppCmd) Start() error {
 		cmd.logger.Error("egret/harness: app died")
 		return errors.New("egret/harness: app died")
 
-	case <-time.After(30 * time.Second):
+	case <-time.After(timeout):
 		cmd.Kill()
-		cmd.logger.Error("egret/harness: app timed out")
+		cmd.logger.Error("egret/harness: app timed out", zap.Duration("timeout", timeout))
 		return errors.New("egret/harness: app timed out")
 
-	case <-listeningWriter.notifyReady:
+	case <-ready:
 		return nil
 	}
 	// panic("Impossible")
 }
 
 // Run the app server inline.  Never returns.
+// Interrupting egret stops the app gracefully.
 func (cmd AppCmd) Run() {
 	cmd.logger.Info("Exec app", zap.String("path", cmd.Path), zap.Strings("args", cmd.Args))
-	if err := cmd.Cmd.Run(); err != nil {
+	if err := cmd.Cmd.Start(); err != nil {
 		cmd.logger.Error("Error running", zap.Error(err))
+		return
+	}
+
+	ch := make(chan os.Signal, 1)
+	signal.Notify(ch, os.Interrupt, syscall.SIGTERM)
+	defer signal.Stop(ch)
+
+	select {
+	case <-cmd.waitChan():
+		if cmd.exit.err != nil {
+			cmd.logger.Error("Error running", zap.Error(cmd.exit.err))
+		}
+	case <-ch:
+		cmd.Kill()
 	}
 }
 
 // Terminate the app server if it's running.
+// The app's process group is asked to stop first, and killed once the
+// harness.kill.grace period has elapsed.
 func (cmd AppCmd) Kill() {
-	if cmd.Cmd != nil && (cmd.ProcessState == nil || !cmd.ProcessState.Exited()) {
-		cmd.logger.Info("Killing egret server pid: " + cast.ToString(cmd.Process.Pid))
-		err := cmd.Process.Kill()
-		if err != nil {
-			cmd.logger.Error("Failed to kill egret server", zap.Error(err))
-		}
+	if cmd.Cmd == nil || cmd.Process == nil {
+		return
+	}
+	atomic.StoreInt32(&cmd.exit.stopped, 1)
+
+	done := cmd.waitChan()
+	select {
+	case <-done:
+		// Already exited, but don't leave any of its children behind.
+		killProcessGroup(cmd.Process)
+		return
+	default:
+	}
+
+	configMu.RLock()
+	grace, err := time.ParseDuration(egret.Config.GetStringDefault("harness.kill.grace", "5s"))
+	configMu.RUnlock()
+	if err != nil {
+		cmd.logger.Warn("Invalid harness.kill.grace, using 5s", zap.Error(err))
+		grace = 5 * time.Second
 	}
+
+	cmd.logger.Info("Stopping egret server pid: " + cast.ToString(cmd.Process.Pid))
+	stop := terminateProcess
+	if cmd.debug {
+		// Delve detaches and kills the app it launched when interrupted.
+		stop = interruptProcess
+	}
+	if err := stop(cmd.Process); err != nil {
+		cmd.logger.Error("Failed to terminate egret server", zap.Error(err))
+	}
+
+	select {
+	case <-done:
+	case <-time.After(grace):
+		cmd.logger.Warn("egret server did not stop in time, killing it", zap.Duration("grace", grace))
+	}
+
+	// Kill whatever is left of the process group, including orphaned children.
+	if err := killProcessGroup(cmd.Process); err != nil {
+		cmd.logger.Error("Failed to kill egret server", zap.Error(err))
+	}
+	<-done
+
+	cmd.logger.Info("egret server stopped",
+		zap.Int("pid", cmd.Process.Pid),
+		zap.String("state", cmd.ProcessState.String()))
 }
 
-// Return a channel that is notified when Wait() returns.
-func (cmd AppCmd) waitChan() <-chan struct{} {
-	ch := make(chan struct{}, 1)
-	go func() {
-		cmd.Wait()
-		ch <- struct{}{}
-	}()
-	return ch
+// Crashed reports whether the app has exited without being killed by the harness.
+func (cmd AppCmd) Crashed() bool {
+	if cmd.Process == nil || atomic.LoadInt32(&cmd.exit.stopped) == 1 {
+		return false
+	}
+	select {
+	case <-cmd.waitChan():
+		return true
+	default:
+		return false
+	}
+}
+
+// Panic returns the panic the app died of, if it can be found in its stderr.
+func (cmd AppCmd) Panic() *Panic {
+	return parsePanic(cmd.stderr.Bytes())
 }
 
-// A io.Writer that copies to the destination, and listens for "Listening on.."
-// in the stream.  (Which tells us when the egret server has finished starting up)
-// This is super ghetto, but by far the simplest thing that should work.
-type startupListeningWriter struct {
-	dest        io.Writer
-	notifyReady chan bool
+// Return a channel that is closed when Wait() returns.
+func (cmd AppCmd) waitChan() <-chan struct{} {
+	cmd.exit.once.Do(func() {
+		go func() {
+			cmd.exit.err = cmd.Wait()
+			cmd.stdoutLog.Flush()
+			cmd.stderrLog.Flush()
+			close(cmd.exit.done)
+		}()
+	})
+	return cmd.exit.done
 }
 
-func (w startupListeningWriter) Write(p []byte) (n int, err error) {
-	if w.notifyReady != nil && bytes.Contains(p, []byte("listen")) {
-		w.notifyReady <- true
-		w.notifyReady = nil
+// waitReady returns a channel that is closed once the app accepts TCP
+// connections on port and, if readyPath is not empty, answers a GET request
+// to it with a non-5xx status.  Probing stops when done is closed.  The port
+// must be set, as there is no telling which one the app picks otherwise.
+func waitReady(port int, readyPath string, done <-chan struct{}) (<-chan struct{}, error) {
+	if port <= 0 {
+		return nil, fmt.Errorf("egret/harness: no port to probe the app on (got %d)", port)
+	}
+	ready := make(chan struct{})
+	host := egret.HttpAddr
+	if host == "" {
+		host = "localhost"
+	}
+	addr := net.JoinHostPort(host, strconv.Itoa(port))
+
+	scheme := "http"
+	client := &http.Client{Timeout: time.Second}
+	if egret.HttpTLSEnabled {
+		scheme = "https"
+		client.Transport = &http.Transport{
+			TLSClientConfig: insecureTLSConfig(),
+		}
 	}
-	return w.dest.Write(p)
+
+	go func() {
+		ticker := time.NewTicker(100 * time.Millisecond)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-done:
+				return
+			case <-ticker.C:
+			}
+
+			conn, err := net.DialTimeout("tcp", addr, time.Second)
+			if err != nil {
+				continue
+			}
+			conn.Close()
+
+			if readyPath != "" {
+				resp, err := client.Get(scheme + "://" + addr + readyPath)
+				if err != nil {
+					continue
+				}
+				resp.Body.Close()
+				if resp.StatusCode >= http.StatusInternalServerError {
+					continue
+				}
+			}
+
+			close(ready)
+			return
+		}
+	}()
+	return ready, nil
 }
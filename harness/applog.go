@@ -0,0 +1,281 @@
+package harness
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/agtorre/gocolorize"
+	"go.uber.org/zap"
+
+	"github.com/kenorld/egret-core"
+)
+
+// LogLevel, if set, overrides harness.log.level.
+var LogLevel string
+
+// maxLogLine is the length after which an unterminated line is written out.
+const maxLogLine = 64 * 1024
+
+// logLevels ranks the levels of structured logs.
+var logLevels = map[string]int{
+	"trace":   -1,
+	"debug":   0,
+	"info":    1,
+	"warn":    2,
+	"warning": 2,
+	"error":   3,
+	"dpanic":  4,
+	"panic":   4,
+	"fatal":   5,
+}
+
+var levelColors = map[int]gocolorize.Colorize{
+	-1: gocolorize.NewColor("white"),
+	0:  gocolorize.NewColor("magenta"),
+	1:  gocolorize.NewColor("blue"),
+	2:  gocolorize.NewColor("yellow"),
+	3:  gocolorize.NewColor("red"),
+	4:  gocolorize.NewColor("red"),
+	5:  gocolorize.NewColor("red"),
+}
+
+var dimColor = gocolorize.NewColor("black+h")
+
+var (
+	logFileMu sync.Mutex
+	logFiles  = make(map[string]*os.File)
+)
+
+// appLogWriter renders the app's output on the terminal, one line at a time.
+// JSON log lines (zap, logrus, slog and alike) are shown as
+//
+//	15:04:05.000 [app] INFO  message  key=value ...
+//
+// and dropped if below harness.log.level.  Other lines are shown as written,
+// with the time and prefix.  The prefix is harness.log.prefix, the app name
+// by default.  harness.log.color and harness.log.timestamps turn colors and
+// times off.
+type appLogWriter struct {
+	mu         sync.Mutex
+	w          io.Writer
+	prefix     string
+	minLevel   int
+	color      bool
+	timestamps bool
+	partial    []byte
+}
+
+func newAppLogWriter(w io.Writer, logger *zap.Logger) *appLogWriter {
+	level := LogLevel
+	if level == "" {
+		level = egret.Config.GetStringDefault("harness.log.level", "debug")
+	}
+	minLevel, ok := logLevels[strings.ToLower(level)]
+	if !ok {
+		logger.Warn("Unknown harness.log.level, showing every level", zap.String("level", level))
+		minLevel = -1
+	}
+
+	prefix := egret.AppName
+	if os.Getenv("EGRET_SERVICE") != "" {
+		// Run in a workspace, which prefixes every line with the service.
+		prefix = ""
+	}
+	return &appLogWriter{
+		w:          w,
+		prefix:     egret.Config.GetStringDefault("harness.log.prefix", prefix),
+		minLevel:   minLevel,
+		color:      egret.Config.GetBoolDefault("harness.log.color", true),
+		timestamps: egret.Config.GetBoolDefault("harness.log.timestamps", true),
+	}
+}
+
+func (l *appLogWriter) Write(p []byte) (int, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.partial = append(l.partial, p...)
+	for {
+		i := bytes.IndexByte(l.partial, '\n')
+		if i < 0 {
+			break
+		}
+		l.writeLine(l.partial[:i])
+		l.partial = l.partial[i+1:]
+	}
+	if len(l.partial) > maxLogLine {
+		l.writeLine(l.partial)
+		l.partial = l.partial[:0]
+	}
+	return len(p), nil
+}
+
+// Flush writes out the last line, if it wasn't terminated.
+func (l *appLogWriter) Flush() {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if len(l.partial) > 0 {
+		l.writeLine(l.partial)
+		l.partial = nil
+	}
+}
+
+func (l *appLogWriter) writeLine(line []byte) {
+	line = bytes.TrimRight(line, "\r")
+	var b strings.Builder
+	if trimmed := bytes.TrimSpace(line); len(trimmed) > 0 && trimmed[0] == '{' {
+		if entry, ok := parseLogEntry(trimmed); ok {
+			if entry.level < l.minLevel {
+				return
+			}
+			l.header(&b, entry.time)
+			l.entry(&b, entry)
+			b.WriteByte('\n')
+			io.WriteString(l.w, b.String())
+			return
+		}
+	}
+	l.header(&b, time.Now())
+	b.Write(line)
+	b.WriteByte('\n')
+	io.WriteString(l.w, b.String())
+}
+
+func (l *appLogWriter) header(b *strings.Builder, t time.Time) {
+	if l.timestamps {
+		b.WriteString(l.paint(dimColor, t.Format("15:04:05.000")))
+		b.WriteByte(' ')
+	}
+	if l.prefix != "" {
+		b.WriteString("[" + l.prefix + "] ")
+	}
+}
+
+func (l *appLogWriter) entry(b *strings.Builder, e *logEntry) {
+	b.WriteString(l.paint(levelColors[e.level], fmt.Sprintf("%-5s", strings.ToUpper(e.levelName))))
+	b.WriteString(" " + e.msg)
+	if e.caller != "" {
+		b.WriteString("  " + l.paint(dimColor, e.caller))
+	}
+	for _, f := range e.fields {
+		b.WriteString("  " + l.paint(dimColor, f[0]+"=") + f[1])
+	}
+}
+
+func (l *appLogWriter) paint(c gocolorize.Colorize, s string) string {
+	if !l.color {
+		return s
+	}
+	return c.Paint(s)
+}
+
+// logEntry is a parsed JSON log line.
+type logEntry struct {
+	level     int
+	levelName string
+	time      time.Time
+	msg       string
+	caller    string
+	fields    [][2]string // other fields, in order
+}
+
+// parseLogEntry parses a JSON log line.  It requires a level and a message.
+func parseLogEntry(line []byte) (*logEntry, bool) {
+	dec := json.NewDecoder(bytes.NewReader(line))
+	dec.UseNumber()
+	if t, err := dec.Token(); err != nil || t != json.Delim('{') {
+		return nil, false
+	}
+
+	e := &logEntry{time: time.Now()}
+	hasLevel, hasMsg := false, false
+	for dec.More() {
+		t, err := dec.Token()
+		if err != nil {
+			return nil, false
+		}
+		key, _ := t.(string)
+		var raw json.RawMessage
+		if err := dec.Decode(&raw); err != nil {
+			return nil, false
+		}
+		var s string
+		isString := json.Unmarshal(raw, &s) == nil
+
+		switch strings.ToLower(key) {
+		case "level", "lvl", "severity":
+			if isString {
+				if level, ok := logLevels[strings.ToLower(s)]; ok {
+					e.level, e.levelName, hasLevel = level, s, true
+					continue
+				}
+			}
+		case "msg", "message":
+			if isString && !hasMsg {
+				e.msg, hasMsg = s, true
+				continue
+			}
+		case "ts", "time", "timestamp":
+			if t, ok := parseLogTime(raw, s, isString); ok {
+				e.time = t
+				continue
+			}
+		case "caller":
+			if isString {
+				e.caller = s
+				continue
+			}
+		}
+		value := string(raw)
+		if isString && !strings.ContainsAny(s, " \t\n\"=") {
+			value = s
+		}
+		e.fields = append(e.fields, [2]string{key, value})
+	}
+	return e, hasLevel && hasMsg
+}
+
+// parseLogTime parses a timestamp as RFC 3339, or as seconds (zap) or
+// milliseconds since the epoch.
+func parseLogTime(raw json.RawMessage, s string, isString bool) (time.Time, bool) {
+	if isString {
+		t, err := time.Parse(time.RFC3339Nano, s)
+		return t.Local(), err == nil
+	}
+	f, err := strconv.ParseFloat(string(raw), 64)
+	if err != nil {
+		return time.Time{}, false
+	}
+	if f > 1e12 {
+		f /= 1000
+	}
+	sec := int64(f)
+	return time.Unix(sec, int64((f-float64(sec))*1e9)), true
+}
+
+// appLogFile returns the file harness.log.file names, opened for appending,
+// or nil if none is set.  The file is shared by every app instance.
+func appLogFile(logger *zap.Logger) io.Writer {
+	filename := egret.Config.GetStringDefault("harness.log.file", "")
+	if filename == "" {
+		return nil
+	}
+	logFileMu.Lock()
+	defer logFileMu.Unlock()
+	if f, ok := logFiles[filename]; ok {
+		return f
+	}
+	f, err := os.OpenFile(filename, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0666)
+	if err != nil {
+		logger.Error("Failed to open harness.log.file", zap.String("file", filename), zap.Error(err))
+		return nil
+	}
+	logFiles[filename] = f
+	return f
+}
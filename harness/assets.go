@@ -0,0 +1,440 @@
+package harness
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"go.uber.org/zap"
+
+	"github.com/kenorld/egret-core"
+)
+
+const (
+	assetErrorName = "asset_error"
+	manifestName   = "manifest.json"
+	// fingerprintLength is the number of hex digits of the content hash put
+	// in the names of the bundles.
+	fingerprintLength = 8
+)
+
+// Assets is the asset pipeline of the app's public directory.  It bundles
+// stylesheets and scripts, minifies and fingerprints them, and writes a
+// manifest mapping each bundle to its URL, for the app to link to, e.g.
+//
+//	{"app.css": "/public/assets/app.1f2e3d4c.css"}
+//
+// It is set up by:
+//
+//	assets.bundles      a map of bundle names to globs, or one bundle per
+//	                    line or list item, as "name: glob, glob", with
+//	                    globs relative to assets.dir ("**" matches any
+//	                    number of directories), e.g. "app.js: js/lib/*.js, js/app.js"
+//	assets.dir          directory of the sources (public)
+//	assets.output       directory the bundles and manifest.json are written
+//	                    to, within assets.dir (public/assets)
+//	assets.url          URL assets.dir is served at (/public)
+//	assets.minify       minify .css and .js bundles (true)
+//	assets.fingerprint  put the hash of their content in the bundles' names
+//	                    (true)
+//
+// Files are concatenated in the order of the globs, in lexical order within
+// a glob.  Relative url(...) references of stylesheets are rewritten to
+// point to the same files from the bundle.  Only the bundles whose sources
+// changed are built again.
+type Assets struct {
+	dir         string
+	output      string
+	url         string
+	minify      bool
+	fingerprint bool
+	logger      *zap.Logger
+
+	mu       sync.Mutex
+	bundles  []*bundle
+	manifest map[string]string // URL of each bundle, by name
+	written  bool              // the manifest was written
+}
+
+// bundle is a file built from the sources matching a list of globs.
+type bundle struct {
+	name   string   // path relative to the output directory, e.g. "js/app.js"
+	inputs []string // slash separated globs relative to the sources directory
+	hash   string   // hash of the content last written
+	stale  bool     // a source changed since the bundle was last built
+}
+
+// NewAssets method returns the app's asset pipeline, or nil if no bundles
+// are configured.
+func NewAssets(logger *zap.Logger) (*Assets, error) {
+	a := &Assets{
+		dir:         filepath.Join(egret.BasePath, egret.Config.GetStringDefault("assets.dir", "public")),
+		output:      filepath.Join(egret.BasePath, egret.Config.GetStringDefault("assets.output", "public/assets")),
+		url:         strings.TrimSuffix(egret.Config.GetStringDefault("assets.url", "/public"), "/"),
+		minify:      egret.Config.GetBoolDefault("assets.minify", true),
+		fingerprint: egret.Config.GetBoolDefault("assets.fingerprint", true),
+		logger:      logger,
+		manifest:    make(map[string]string),
+	}
+	if rel, err := filepath.Rel(a.dir, a.output); err != nil || rel == "." || strings.HasPrefix(rel, "..") {
+		return nil, fmt.Errorf("assets.output: %s is not within assets.dir %s", a.output, a.dir)
+	}
+
+	lines, err := configEntries("assets.bundles")
+	if err != nil {
+		return nil, err
+	}
+	names := make(map[string]bool)
+	for _, line := range lines {
+		i := strings.Index(line, ":")
+		if i < 0 {
+			return nil, fmt.Errorf("assets.bundles: %q is not a \"name: glob, glob\" line", line)
+		}
+		b := &bundle{name: path.Clean(strings.TrimSpace(line[:i])), stale: true}
+		if b.name == "." || strings.HasPrefix(b.name, "../") || path.IsAbs(b.name) || b.name == manifestName {
+			return nil, fmt.Errorf("assets.bundles: invalid bundle name %q", b.name)
+		}
+		if names[b.name] {
+			return nil, fmt.Errorf("assets.bundles: duplicate bundle %q", b.name)
+		}
+		names[b.name] = true
+		for _, glob := range strings.Split(line[i+1:], ",") {
+			if glob = strings.TrimSpace(glob); glob != "" {
+				b.inputs = append(b.inputs, strings.TrimPrefix(glob, "/"))
+			}
+		}
+		if len(b.inputs) == 0 {
+			return nil, fmt.Errorf("assets.bundles: no sources for bundle %q", b.name)
+		}
+		a.bundles = append(a.bundles, b)
+	}
+	if len(a.bundles) == 0 {
+		return nil, nil
+	}
+
+	// Start from the manifest of the last run, so that its outputs are
+	// replaced rather than left behind.
+	if data, err := ioutil.ReadFile(filepath.Join(a.output, manifestName)); err == nil {
+		json.Unmarshal(data, &a.manifest)
+	}
+	return a, nil
+}
+
+// changed marks the bundles built from filename as stale, and reports
+// whether there was any.
+func (a *Assets) changed(filename string) bool {
+	if a == nil {
+		return false
+	}
+	rel, err := filepath.Rel(a.dir, filename)
+	if err != nil || strings.HasPrefix(rel, "..") || a.isOutput(filename) {
+		return false
+	}
+	rel = filepath.ToSlash(rel)
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	stale := false
+	for _, b := range a.bundles {
+		for _, glob := range b.inputs {
+			if matchSegments(strings.Split(glob, "/"), strings.Split(rel, "/")) {
+				b.stale, stale = true, true
+				break
+			}
+		}
+	}
+	return stale
+}
+
+// isOutput reports whether filename is written by the pipeline.
+func (a *Assets) isOutput(filename string) bool {
+	if a == nil {
+		return false
+	}
+	rel, err := filepath.Rel(a.output, filename)
+	return err == nil && !strings.HasPrefix(rel, "..")
+}
+
+// Build method builds the stale bundles, and writes the manifest.  It
+// reports whether the URL of any bundle changed.
+func (a *Assets) Build() (bool, *egret.Error) {
+	if a == nil {
+		return false, nil
+	}
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	changed := false
+	for _, b := range a.bundles {
+		if !b.stale {
+			continue
+		}
+		url, err := a.build(b)
+		if err != nil {
+			a.logger.Error("Failed to build asset bundle", zap.String("bundle", b.name), zap.Error(err))
+			return false, &egret.Error{
+				Name:    assetErrorName,
+				Title:   "Asset Pipeline Error",
+				Path:    b.name,
+				Summary: fmt.Sprintf("Failed to build %s: %s", b.name, err),
+			}
+		}
+		b.stale = false
+		if a.manifest[b.name] != url {
+			a.manifest[b.name] = url
+			changed = true
+		}
+	}
+
+	if changed || !a.written {
+		// Bundles no longer configured are dropped.
+		for name, url := range a.manifest {
+			if !a.configured(name) {
+				a.remove(url)
+				delete(a.manifest, name)
+			}
+		}
+		data, _ := json.MarshalIndent(a.manifest, "", "  ")
+		if err := writeFileAtomic(filepath.Join(a.output, manifestName), append(data, '\n')); err != nil {
+			return false, &egret.Error{
+				Name:    assetErrorName,
+				Title:   "Asset Pipeline Error",
+				Summary: "Failed to write the asset manifest: " + err.Error(),
+			}
+		}
+		a.written = true
+	}
+	return changed, nil
+}
+
+func (a *Assets) configured(name string) bool {
+	for _, b := range a.bundles {
+		if b.name == name {
+			return true
+		}
+	}
+	return false
+}
+
+// build writes bundle b, unless its content didn't change, and returns its
+// URL.
+func (a *Assets) build(b *bundle) (string, error) {
+	started := time.Now()
+	files, err := a.sources(b)
+	if err != nil {
+		return "", err
+	}
+
+	ext := path.Ext(b.name)
+	separator := "\n"
+	if ext == ".js" {
+		// Keep a script without a final semicolon from running into the next.
+		separator = ";\n"
+	}
+	// Directory of the bundle, relative to the sources directory.
+	outDir, err := filepath.Rel(a.dir, filepath.Join(a.output, filepath.FromSlash(path.Dir(b.name))))
+	if err != nil {
+		return "", err
+	}
+	var content []byte
+	for i, file := range files {
+		data, err := ioutil.ReadFile(filepath.Join(a.dir, filepath.FromSlash(file)))
+		if err != nil {
+			return "", err
+		}
+		if ext == ".css" {
+			data = rebaseURLs(data, path.Dir(file), filepath.ToSlash(outDir))
+		}
+		if a.minify {
+			data = a.minifyFile(file, ext, data)
+		}
+		if i > 0 {
+			content = append(content, separator...)
+		}
+		content = append(content, data...)
+	}
+	content = append(content, '\n')
+
+	sum := sha256.Sum256(content)
+	hash := hex.EncodeToString(sum[:])
+	name := b.name
+	if a.fingerprint {
+		name = strings.TrimSuffix(name, ext) + "." + hash[:fingerprintLength] + ext
+	}
+	target := filepath.Join(a.output, filepath.FromSlash(name))
+	rel, _ := filepath.Rel(a.dir, target)
+	url := a.url + "/" + filepath.ToSlash(rel)
+
+	if _, err := os.Stat(target); err == nil && hash == b.hash {
+		return url, nil
+	}
+	if err := writeFileAtomic(target, content); err != nil {
+		return "", err
+	}
+	b.hash = hash
+
+	// Remove the previous fingerprinted file.
+	if previous := a.manifest[b.name]; previous != url {
+		a.remove(previous)
+	}
+	a.logger.Info("Built asset bundle",
+		zap.String("bundle", b.name),
+		zap.String("url", url),
+		zap.Int("files", len(files)),
+		zap.Int("bytes", len(content)),
+		zap.Duration("took", time.Since(started)))
+	return url, nil
+}
+
+// remove removes the output file served at url.
+func (a *Assets) remove(url string) {
+	if !strings.HasPrefix(url, a.url+"/") {
+		return
+	}
+	filename := filepath.Join(a.dir, filepath.FromSlash(strings.TrimPrefix(url, a.url+"/")))
+	if a.isOutput(filename) {
+		os.Remove(filename)
+	}
+}
+
+// sources returns the files bundle b is built from, relative to the sources
+// directory, in order.
+func (a *Assets) sources(b *bundle) ([]string, error) {
+	var all []string
+	err := filepath.Walk(a.dir, func(filename string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if info.IsDir() {
+			if filename == a.output {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		rel, _ := filepath.Rel(a.dir, filename)
+		all = append(all, filepath.ToSlash(rel))
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	sort.Strings(all)
+
+	var files []string
+	seen := make(map[string]bool)
+	for _, glob := range b.inputs {
+		matched := false
+		for _, file := range all {
+			if matchSegments(strings.Split(glob, "/"), strings.Split(file, "/")) {
+				matched = true
+				if !seen[file] {
+					seen[file] = true
+					files = append(files, file)
+				}
+			}
+		}
+		if !matched {
+			return nil, fmt.Errorf("no file matches %s", glob)
+		}
+	}
+	return files, nil
+}
+
+// cssURLPattern matches the url(...) references of a stylesheet.
+var cssURLPattern = regexp.MustCompile(`url\(\s*(['"]?)([^'"()\s]+)(['"]?)\s*\)`)
+
+// rebaseURLs rewrites the relative URLs of a stylesheet in directory from so
+// that they point to the same files from directory to.  Both are slash
+// separated and relative to the same directory.
+func rebaseURLs(css []byte, from, to string) []byte {
+	if from == to {
+		return css
+	}
+	return cssURLPattern.ReplaceAllFunc(css, func(match []byte) []byte {
+		groups := cssURLPattern.FindSubmatch(match)
+		quote, ref := string(groups[1]), string(groups[2])
+		if strings.HasPrefix(ref, "/") || strings.HasPrefix(ref, "#") {
+			return match
+		}
+		if i := strings.IndexAny(ref, ":/?#"); i >= 0 && ref[i] == ':' {
+			// An absolute URL, e.g. data: or https:
+			return match
+		}
+		suffix := ""
+		if i := strings.IndexAny(ref, "?#"); i >= 0 {
+			ref, suffix = ref[:i], ref[i:]
+		}
+		rel, err := filepath.Rel(filepath.FromSlash(to), filepath.FromSlash(path.Join(from, ref)))
+		if err != nil {
+			return match
+		}
+		return []byte("url(" + quote + filepath.ToSlash(rel) + suffix + quote + ")")
+	})
+}
+
+// minifyFile minifies a stylesheet or script, or returns it as is if it
+// can't be parsed.
+func (a *Assets) minifyFile(file, ext string, data []byte) []byte {
+	if strings.Contains(path.Base(file), ".min.") {
+		return data
+	}
+	var (
+		out string
+		err error
+	)
+	switch ext {
+	case ".css":
+		out, err = minifyCSS(string(data))
+	case ".js":
+		out, err = minifyJS(string(data))
+	default:
+		return data
+	}
+	if err != nil {
+		a.logger.Warn("Failed to minify asset, keeping it as is", zap.String("file", file), zap.Error(err))
+		return data
+	}
+	return []byte(out)
+}
+
+// writeFileAtomic writes data to filename through a temporary file, so that
+// it is never served half written.
+func writeFileAtomic(filename string, data []byte) error {
+	if err := os.MkdirAll(filepath.Dir(filename), 0777); err != nil {
+		return err
+	}
+	tmp := filename + ".tmp"
+	if err := ioutil.WriteFile(tmp, data, 0666); err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	if err := os.Rename(tmp, filename); err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	return nil
+}
+
+// reloadAssets reloads the browsers once the bundles were rebuilt.
+func (h *Harness) reloadAssets() *egret.Error {
+	h.mu.Lock()
+	lastError := h.lastError
+	h.mu.Unlock()
+	if lastError != nil {
+		// The app itself is broken, fixing assets doesn't change that.
+		return lastError
+	}
+	if h.reload != nil {
+		h.reload.Broadcast()
+	}
+	return nil
+}
@@ -0,0 +1,269 @@
+package harness
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"go.uber.org/zap"
+)
+
+// newTestAssets returns a pipeline of the given bundles, built from the
+// given files of a temporary public directory.
+func newTestAssets(t *testing.T, files map[string]string, bundles ...*bundle) *Assets {
+	dir := filepath.Join(t.TempDir(), "public")
+	for name, content := range files {
+		filename := filepath.Join(dir, filepath.FromSlash(name))
+		if err := os.MkdirAll(filepath.Dir(filename), 0777); err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(filename, []byte(content), 0666); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for _, b := range bundles {
+		b.stale = true
+	}
+	return &Assets{
+		dir:         dir,
+		output:      filepath.Join(dir, "assets"),
+		url:         "/public",
+		fingerprint: true,
+		logger:      zap.NewNop(),
+		bundles:     bundles,
+		manifest:    make(map[string]string),
+	}
+}
+
+func readManifest(t *testing.T, a *Assets) map[string]string {
+	data, err := ioutil.ReadFile(filepath.Join(a.output, manifestName))
+	if err != nil {
+		t.Fatal(err)
+	}
+	manifest := make(map[string]string)
+	if err := json.Unmarshal(data, &manifest); err != nil {
+		t.Fatal(err)
+	}
+	return manifest
+}
+
+func fingerprint(content string) string {
+	sum := sha256.Sum256([]byte(content))
+	return hex.EncodeToString(sum[:])[:fingerprintLength]
+}
+
+func TestRebaseURLs(t *testing.T) {
+	tests := []struct {
+		from, to string
+		css      string
+		want     string
+	}{
+		{"css", "assets", `a{background:url(img/a.png)}`, `a{background:url(../css/img/a.png)}`},
+		{"css", "assets", `a{background:url('../img/a.png')}`, `a{background:url('../img/a.png')}`},
+		{"css", "assets", `a{background:url( "img/a.png" )}`, `a{background:url("../css/img/a.png")}`},
+		{"css/vendor", "assets/css", `a{background:url(a.png)}`, `a{background:url(../../css/vendor/a.png)}`},
+		{"css", "assets", `a{background:url(/img/a.png)}`, `a{background:url(/img/a.png)}`},
+		{"css", "assets", `a{background:url(data:image/png;base64,iVBORw0KGgo=)}`, `a{background:url(data:image/png;base64,iVBORw0KGgo=)}`},
+		{"css", "assets", `a{background:url(https://cdn.example.com/a.png)}`, `a{background:url(https://cdn.example.com/a.png)}`},
+		{"css", "assets", `a{filter:url(#blur)}`, `a{filter:url(#blur)}`},
+		{"css", "assets", `@font-face{src:url(f.eot?#iefix)}`, `@font-face{src:url(../css/f.eot?#iefix)}`},
+		{"css", "assets", `@font-face{src:url('f.woff?v=2')}`, `@font-face{src:url('../css/f.woff?v=2')}`},
+		{"css", "css", `a{background:url(img/a.png)}`, `a{background:url(img/a.png)}`},
+	}
+	for _, test := range tests {
+		if got := string(rebaseURLs([]byte(test.css), test.from, test.to)); got != test.want {
+			t.Errorf("rebaseURLs(%q, %q, %q) = %q, want %q", test.css, test.from, test.to, got, test.want)
+		}
+	}
+}
+
+func TestAssetsBundleOrder(t *testing.T) {
+	files := map[string]string{
+		"js/lib/b.js":     "B",
+		"js/lib/a.js":     "A",
+		"js/app.js":       "APP",
+		"js/x.min.js":     "var  x = 1",
+		"css/reset.css":   "R",
+		"css/site.css":    "S",
+		"css/theme/a.css": "T",
+	}
+	tests := []struct {
+		name    string
+		inputs  []string
+		minify  bool
+		content string
+	}{
+		// Globs in order, files in lexical order within a glob, each once.
+		{"app.js", []string{"js/lib/*.js", "js/app.js", "js/**/*.js"}, false, "A;\nB;\nAPP;\nvar  x = 1\n"},
+		{"app2.js", []string{"js/app.js", "js/lib/*.js"}, false, "APP;\nA;\nB\n"},
+		{"site.css", []string{"css/reset.css", "css/**/*.css"}, false, "R\nS\nT\n"},
+		// Minified files are kept as they are.
+		{"min.js", []string{"js/x.min.js"}, true, "var  x = 1\n"},
+	}
+	for _, test := range tests {
+		b := &bundle{name: test.name, inputs: test.inputs}
+		a := newTestAssets(t, files, b)
+		a.minify, a.fingerprint = test.minify, false
+		if _, err := a.Build(); err != nil {
+			t.Errorf("%s: Build: %s", test.name, err.Summary)
+			continue
+		}
+		data, err := ioutil.ReadFile(filepath.Join(a.output, test.name))
+		if err != nil {
+			t.Errorf("%s: %s", test.name, err)
+			continue
+		}
+		if string(data) != test.content {
+			t.Errorf("%s = %q, want %q", test.name, data, test.content)
+		}
+	}
+}
+
+func TestAssetsBuildMissingSource(t *testing.T) {
+	a := newTestAssets(t, map[string]string{"js/app.js": "APP"},
+		&bundle{name: "app.js", inputs: []string{"js/app.js", "js/missing/*.js"}})
+	if _, err := a.Build(); err == nil || err.Name != assetErrorName {
+		t.Errorf("Build with a glob matching nothing = %v, want an %s", err, assetErrorName)
+	}
+}
+
+func TestAssetsBuildFingerprint(t *testing.T) {
+	tests := []struct {
+		name        string
+		fingerprint bool
+		content     string
+		url         string
+	}{
+		{"app.js", true, "APP\n", "/public/assets/app." + fingerprint("APP\n") + ".js"},
+		{"js/app.js", true, "APP\n", "/public/assets/js/app." + fingerprint("APP\n") + ".js"},
+		{"app.js", false, "APP\n", "/public/assets/app.js"},
+	}
+	for _, test := range tests {
+		a := newTestAssets(t, map[string]string{"js/app.js": "APP"},
+			&bundle{name: test.name, inputs: []string{"js/app.js"}})
+		a.fingerprint = test.fingerprint
+		changed, eerr := a.Build()
+		if eerr != nil {
+			t.Fatalf("%s: Build: %s", test.name, eerr.Summary)
+		}
+		if !changed {
+			t.Errorf("%s: first Build reported no URL change", test.name)
+		}
+		if manifest := readManifest(t, a); len(manifest) != 1 || manifest[test.name] != test.url {
+			t.Errorf("%s: manifest = %v, want %s mapped to %s", test.name, manifest, test.name, test.url)
+		}
+		data, err := ioutil.ReadFile(filepath.Join(a.dir, filepath.FromSlash(test.url[len("/public/"):])))
+		if err != nil || string(data) != test.content {
+			t.Errorf("%s: %s = %q (%v), want %q", test.name, test.url, data, err, test.content)
+		}
+		if changed, _ := a.Build(); changed {
+			t.Errorf("%s: Build without changes reported a URL change", test.name)
+		}
+	}
+}
+
+func TestAssetsRebuildChangedBundle(t *testing.T) {
+	a := newTestAssets(t, map[string]string{"js/app.js": "APP", "css/site.css": "S"},
+		&bundle{name: "app.js", inputs: []string{"js/*.js"}},
+		&bundle{name: "site.css", inputs: []string{"css/*.css"}})
+	if _, err := a.Build(); err != nil {
+		t.Fatal(err.Summary)
+	}
+	before := readManifest(t, a)
+
+	source := filepath.Join(a.dir, "js", "app.js")
+	if err := ioutil.WriteFile(source, []byte("APP2"), 0666); err != nil {
+		t.Fatal(err)
+	}
+	if !a.changed(source) {
+		t.Fatalf("changed(%s) = false, want true", source)
+	}
+	changed, err := a.Build()
+	if err != nil {
+		t.Fatal(err.Summary)
+	}
+	after := readManifest(t, a)
+	if !changed || after["app.js"] != "/public/assets/app."+fingerprint("APP2\n")+".js" {
+		t.Errorf("Build after a change = %v, manifest %v", changed, after)
+	}
+	if after["site.css"] != before["site.css"] {
+		t.Errorf("site.css changed from %s to %s, want it unchanged", before["site.css"], after["site.css"])
+	}
+	// The previous fingerprinted file is removed.
+	if _, err := os.Stat(filepath.Join(a.output, "app."+fingerprint("APP\n")+".js")); !os.IsNotExist(err) {
+		t.Errorf("previous app.js bundle left behind: %v", err)
+	}
+}
+
+func TestAssetsChanged(t *testing.T) {
+	a := newTestAssets(t, nil,
+		&bundle{name: "app.js", inputs: []string{"js/lib/*.js", "js/app.js"}},
+		&bundle{name: "site.css", inputs: []string{"css/**/*.css"}})
+	tests := []struct {
+		file  string // relative to the parent of the sources directory
+		stale []bool // of each bundle
+	}{
+		{"public/js/app.js", []bool{true, false}},
+		{"public/js/lib/a.js", []bool{true, false}},
+		{"public/js/lib/vendor/a.js", []bool{false, false}},
+		{"public/js/other.js", []bool{false, false}},
+		{"public/css/site.css", []bool{false, true}},
+		{"public/css/theme/dark/a.css", []bool{false, true}},
+		{"public/assets/app.1f2e3d4c.js", []bool{false, false}},
+		{"public/assets/css/a.css", []bool{false, false}},
+		{"app/controllers/app.go", []bool{false, false}},
+	}
+	for _, test := range tests {
+		for _, b := range a.bundles {
+			b.stale = false
+		}
+		filename := filepath.Join(filepath.Dir(a.dir), filepath.FromSlash(test.file))
+		want := false
+		for _, stale := range test.stale {
+			want = want || stale
+		}
+		if got := a.changed(filename); got != want {
+			t.Errorf("changed(%s) = %v, want %v", test.file, got, want)
+		}
+		for i, b := range a.bundles {
+			if b.stale != test.stale[i] {
+				t.Errorf("changed(%s): %s stale = %v, want %v", test.file, b.name, b.stale, test.stale[i])
+			}
+		}
+	}
+
+	var none *Assets
+	if none.changed(filepath.Join(a.dir, "js", "app.js")) {
+		t.Errorf("changed of a nil pipeline = true, want false")
+	}
+}
+
+func TestAssetsIsOutput(t *testing.T) {
+	a := newTestAssets(t, nil, &bundle{name: "app.js", inputs: []string{"js/*.js"}})
+	tests := []struct {
+		file string // relative to the parent of the sources directory
+		want bool
+	}{
+		{"public/assets/app.1f2e3d4c.js", true},
+		{"public/assets/manifest.json", true},
+		{"public/assets/js/app.js", true},
+		{"public/assets", true},
+		{"public/assets2/app.js", false},
+		{"public/js/app.js", false},
+		{"app/views/index.html", false},
+	}
+	for _, test := range tests {
+		filename := filepath.Join(filepath.Dir(a.dir), filepath.FromSlash(test.file))
+		if got := a.isOutput(filename); got != test.want {
+			t.Errorf("isOutput(%s) = %v, want %v", test.file, got, test.want)
+		}
+	}
+	var none *Assets
+	if none.isOutput(filepath.Join(a.output, "app.js")) {
+		t.Errorf("isOutput of a nil pipeline = true, want false")
+	}
+}
@@ -2,13 +2,13 @@ package harness
 
 import (
 	"fmt"
+	"io/ioutil"
 	"os"
 	"os/exec"
 	"path"
 	"path/filepath"
 	"regexp"
 	"runtime"
-	"strconv"
 	"strings"
 	"time"
 
@@ -17,18 +17,46 @@ import (
 	"github.com/kenorld/egret-core"
 )
 
-var importErrorPattern = regexp.MustCompile("cannot find package \"([^\"]+)\"")
+// oldBuildAge is how long builds are kept before they're considered left
+// behind.
+const oldBuildAge = 24 * time.Hour
+
+var importErrorPattern = regexp.MustCompile(`(?:cannot find package|no required module provides package) "?([^"\s;:]+)"?`)
 
 // Build the app:
-// 1. Generate the the main.go file.
-// 2. Run the appropriate "go build" command.
+// 1. Run the build.hooks.pre commands.
+// 2. Build the asset bundles, which the hooks may generate sources of.
+// 3. Run the appropriate "go build" command.
+// 4. Run the build.hooks.post commands.
 // Requires that egret.Init has been called previously.
 // Returns the path to the built binary, and an error if there was a problem building it.
 func Build(logger *zap.Logger, buildFlags ...string) (app *App, compileError *egret.Error) {
-	if compileError != nil {
+	hooks, err := newBuildHooks()
+	if err != nil {
+		return nil, configError(err)
+	}
+	assets, err := NewAssets(logger)
+	if err != nil {
+		return nil, configError(err)
+	}
+	if compileError = hooks.run("pre", logger); compileError != nil {
+		return nil, compileError
+	}
+	if _, compileError = assets.Build(); compileError != nil {
 		return nil, compileError
 	}
+	if app, compileError, _ = buildApp(logger, buildFlags); compileError != nil {
+		return nil, compileError
+	}
+	if compileError = hooks.run("post", logger); compileError != nil {
+		return nil, compileError
+	}
+	return app, nil
+}
 
+// buildApp runs "go build" for Build, without the hooks, additionally
+// returning every compile error found in its output.
+func buildApp(logger *zap.Logger, buildFlags []string) (app *App, compileError *egret.Error, compileErrors []CompileError) {
 	// Read build config.
 	buildTags := egret.Config.GetStringDefault("build.tags", "")
 
@@ -39,15 +67,33 @@ func Build(logger *zap.Logger, buildFlags ...string) (app *App, compileError *eg
 		logger.Fatal("Go executable not found in PATH")
 	}
 
-	// pkg, err := build.Default.Import(egret.ImportPath, "", build.FindOnly)
-	// if err != nil {
-	// 	logger.Warn("Failure importing", zap.String("import_path", egret.ImportPath))
-	// }
-	// // Binary path is a combination of $GOBIN/egret.d directory, app's import path and its name.
-	// binName := filepath.Join(pkg.BinDir, "egret.d", egret.ImportPath, filepath.Base(egret.BasePath))
+	// In module mode the build runs from the module root against the app's
+	// package directory, otherwise the app is built by its import path.
+	modRoot := findModuleRoot(egret.BasePath)
+	target := path.Join(egret.ImportPath)
+	if modRoot != "" {
+		target = moduleTarget(modRoot, egret.BasePath)
+	}
 
-	binPath := filepath.Join(os.Getenv("GOPATH"), "bin")
-	binName := filepath.Join(binPath, "egret.d", egret.ImportPath, filepath.Base(egret.BasePath))
+	// Compile errors are reported relative to the directory the build runs in.
+	buildDir := modRoot
+	if buildDir == "" {
+		buildDir, _ = os.Getwd()
+	}
+
+	// Every build goes to a directory of its own, under the per-project
+	// cache directory and app's import path, so that it never overwrites the
+	// binary of an instance still running.  The binary is named after the app.
+	buildsDir := filepath.Join(appBinDir(logger), filepath.FromSlash(egret.ImportPath), "builds")
+	removeOldBuilds(buildsDir, logger)
+	if err := os.MkdirAll(buildsDir, 0777); err != nil {
+		return nil, buildDirError(err), nil
+	}
+	dir, err := ioutil.TempDir(buildsDir, "")
+	if err != nil {
+		return nil, buildDirError(err), nil
+	}
+	binName := filepath.Join(dir, filepath.Base(egret.BasePath))
 
 	// Change binary path for Windows build
 	goos := runtime.GOOS
@@ -67,7 +113,6 @@ func Build(logger *zap.Logger, buildFlags ...string) (app *App, compileError *eg
 
 		flags := []string{
 			"build",
-			"-i",
 			"-ldflags", versionLinkerFlags,
 			"-tags", buildTags,
 			"-o", binName}
@@ -76,44 +121,128 @@ func Build(logger *zap.Logger, buildFlags ...string) (app *App, compileError *eg
 		flags = append(flags, buildFlags...)
 
 		// The main path
-		flags = append(flags, path.Join(egret.ImportPath))
+		flags = append(flags, target)
 
 		buildCmd := exec.Command(goPath, flags...)
+		buildCmd.Dir = modRoot
 		logger.Info("Exec command", zap.Strings("args", buildCmd.Args))
 		output, err := buildCmd.CombinedOutput()
 
 		// If the build succeeded, we're done.
 		if err == nil {
-			return NewApp(binName, logger), nil
+			app = NewApp(binName, logger)
+			app.buildDir = dir
+			return app, nil, nil
 		}
-		logger.Error(string(output))
+		os.RemoveAll(dir)
+		// The errors found in it are logged by newCompileError.
+		logger.Debug(string(output))
 
 		// See if it was an import error that we can go get.
 		matches := importErrorPattern.FindStringSubmatch(string(output))
 		if matches == nil {
-			return nil, newCompileError(output, logger)
+			compileError, compileErrors = newCompileError(output, buildDir, logger)
+			return nil, compileError, compileErrors
 		}
 
 		// Ensure we haven't already tried to go get it.
 		pkgName := matches[1]
 		if _, alreadyTried := gotten[pkgName]; alreadyTried {
-			return nil, newCompileError(output, logger)
+			compileError, compileErrors = newCompileError(output, buildDir, logger)
+			return nil, compileError, compileErrors
 		}
 		gotten[pkgName] = struct{}{}
 
 		// Execute "go get <pkg>"
 		getCmd := exec.Command(goPath, "get", pkgName)
+		getCmd.Dir = modRoot
 		logger.Info("Exec command", zap.Strings("args", getCmd.Args))
 		getOutput, err := getCmd.CombinedOutput()
 		if err != nil {
 			logger.Error(string(getOutput))
-			return nil, newCompileError(output, logger)
+			compileError, compileErrors = newCompileError(output, buildDir, logger)
+			return nil, compileError, compileErrors
 		}
 
 		// Success getting the import, attempt to build again.
 	}
 	logger.Fatal("Not reachable")
-	return nil, nil
+	return nil, nil, nil
+}
+
+// buildDirError returns the Error of a build directory that can't be created.
+func buildDirError(err error) *egret.Error {
+	return &egret.Error{
+		Name:    "build_error",
+		Title:   "Build Error",
+		Summary: "Cannot create the build directory: " + err.Error(),
+	}
+}
+
+// removeOldBuilds removes the builds left behind in dir for longer than
+// oldBuildAge, e.g. by a harness that was killed.
+func removeOldBuilds(dir string, logger *zap.Logger) {
+	infos, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return
+	}
+	for _, info := range infos {
+		if time.Since(info.ModTime()) > oldBuildAge {
+			if err := os.RemoveAll(filepath.Join(dir, info.Name())); err != nil {
+				logger.Warn("Failed to remove old build", zap.String("dir", info.Name()), zap.Error(err))
+			}
+		}
+	}
+}
+
+// findModuleRoot returns the directory of the go.mod file governing dir,
+// or an empty string if the app is to be built in GOPATH mode.
+func findModuleRoot(dir string) string {
+	if os.Getenv("GO111MODULE") == "off" {
+		return ""
+	}
+	dir, err := filepath.Abs(dir)
+	if err != nil {
+		return ""
+	}
+	for {
+		if fi, err := os.Stat(filepath.Join(dir, "go.mod")); err == nil && !fi.IsDir() {
+			return dir
+		}
+		parent := filepath.Dir(dir)
+		if parent == dir {
+			return ""
+		}
+		dir = parent
+	}
+}
+
+// moduleTarget returns the package pattern of the app relative to its module root,
+// e.g. "." or "./cmd/server".
+func moduleTarget(modRoot, basePath string) string {
+	absBase, err := filepath.Abs(basePath)
+	if err != nil {
+		return "."
+	}
+	rel, err := filepath.Rel(modRoot, absBase)
+	if err != nil || rel == "." {
+		return "."
+	}
+	return "./" + filepath.ToSlash(rel)
+}
+
+// appBinDir returns the directory where built app binaries are placed.
+// It prefers the user cache directory (e.g. ~/.cache/egret/bin) and falls back
+// to $GOPATH/bin/egret.d, then to the system temp directory.
+func appBinDir(logger *zap.Logger) string {
+	if cacheDir, err := os.UserCacheDir(); err == nil {
+		return filepath.Join(cacheDir, "egret", "bin")
+	}
+	if goPath := os.Getenv("GOPATH"); goPath != "" {
+		return filepath.Join(filepath.SplitList(goPath)[0], "bin", "egret.d")
+	}
+	logger.Warn("No cache directory or GOPATH available, using temp dir for binaries")
+	return filepath.Join(os.TempDir(), "egret", "bin")
 }
 
 // Try to define a version string for the compiled app
@@ -160,43 +289,44 @@ func containsValue(m map[string]string, val string) bool {
 }
 
 // Parse the output of the "go build" command.
-// Return a detailed Error.
-func newCompileError(output []byte, logger *zap.Logger) *egret.Error {
-	errorMatch := regexp.MustCompile(`(?m)^([^:#]+):(\d+):(\d+:)? (.*)$`).
-		FindSubmatch(output)
-	if errorMatch == nil {
-		errorMatch = regexp.MustCompile(`(?m)^(.*?)\:(\d+)\:\s(.*?)$`).FindSubmatch(output)
-
-		if errorMatch == nil {
-			logger.Error("Failed to parse build errors", zap.String("error", string(output)))
-			return &egret.Error{
-				Status:     500,
-				Name:       "compilation_error",
-				SourceType: "Go code",
-				Title:      "Go Compilation Error",
-				Summary:    "See console for build error.",
-			}
-		}
-
-		errorMatch = append(errorMatch, errorMatch[3])
-		logger.Error("Build failed", zap.String("error", string(output)))
+// Return a detailed Error for the first compile error, along with all of them.
+func newCompileError(output []byte, dir string, logger *zap.Logger) (*egret.Error, []CompileError) {
+	compileErrors := parseCompileErrors(output, dir)
+	if len(compileErrors) == 0 {
+		logger.Error("Failed to parse build errors")
+		logger.Error(string(output))
+		return &egret.Error{
+			Status:     500,
+			Name:       "compilation_error",
+			SourceType: "Go code",
+			Title:      "Go Compilation Error",
+			Summary:    "See console for build error.",
+		}, nil
 	}
+	var list strings.Builder
+	printCompileErrors(&list, compileErrors)
+	logger.Error(strings.TrimSpace(list.String()))
 
 	// Read the source for the offending file.
 	var (
-		relFilename    = string(errorMatch[1]) // e.g. "src/egret/sample/core/routes/app.go"
-		absFilename, _ = filepath.Abs(relFilename)
-		line, _        = strconv.Atoi(string(errorMatch[2]))
-		summary        = string(errorMatch[4])
-		compileError   = &egret.Error{
+		first        = compileErrors[0]
+		relFilename  = first.File // e.g. "src/egret/sample/core/routes/app.go"
+		absFilename  = relFilename
+		compileError = &egret.Error{
 			SourceType: "Go code",
 			Name:       "compilation_error",
 			Title:      "Go Compilation Error",
 			Path:       relFilename,
-			Summary:    summary,
-			Line:       line,
+			Summary:    first.Message,
+			Line:       first.Line,
 		}
 	)
+	if !filepath.IsAbs(absFilename) {
+		absFilename = filepath.Join(dir, relFilename)
+	}
+	if len(compileErrors) > 1 {
+		compileError.Summary += fmt.Sprintf(" (and %d more errors)", len(compileErrors)-1)
+	}
 
 	errorLink := egret.Config.GetStringDefault("error.link", "")
 
@@ -208,9 +338,9 @@ func newCompileError(output []byte, logger *zap.Logger) *egret.Error {
 	if err != nil {
 		compileError.MetaError = absFilename + ": " + err.Error()
 		logger.Error("Build compile error", zap.String("file", absFilename), zap.Error(err))
-		return compileError
+		return compileError, compileErrors
 	}
 
 	compileError.SourceLines = fileStr
-	return compileError
+	return compileError, compileErrors
 }
@@ -0,0 +1,439 @@
+package harness
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"runtime"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"go.uber.org/zap"
+
+	"github.com/kenorld/egret-core"
+)
+
+// buildInputEnv are the environment variables affecting "go build".
+var buildInputEnv = []string{"GOOS", "GOARCH", "GOFLAGS", "CGO_ENABLED", "CC", "CGO_CFLAGS", "CGO_LDFLAGS", "GOEXPERIMENT", "APP_VERSION"}
+
+// buildCache keeps the last binaries built, keyed by the hash of the sources
+// and build settings they were built from, so that returning to an earlier
+// state of the sources doesn't need a rebuild.
+//
+// The sources are the Go (and cgo, assembly) files, go.mod, go.sum and
+// vendor/modules.txt under the module root, or under the app's base path in
+// GOPATH mode, along with the files embedded with //go:embed.  So are those
+// of the modules replaced by a local directory in go.mod and, in GOPATH
+// mode, of the packages the app imports from GOPATH.  Other dependencies are
+// identified by go.sum and the vendor manifest only.
+type buildCache struct {
+	dir    string
+	size   int // number of binaries kept
+	logger *zap.Logger
+
+	mu      sync.Mutex
+	stamps  map[string]fileStamp // hashes of the files seen, by path
+	version string               // output of "go version"
+}
+
+// fileStamp is the hash of a file, valid as long as its size and
+// modification time don't change.
+type fileStamp struct {
+	size    int64
+	modTime time.Time
+	hash    string
+	embeds  []string // patterns of the //go:embed directives of a Go file
+}
+
+// newBuildCache returns the cache of the app's binaries, keeping
+// harness.build.cache.size of them (5 by default).  It returns nil if the
+// cache is disabled with a size of 0.
+func newBuildCache(logger *zap.Logger) *buildCache {
+	size := egret.Config.GetIntDefault("harness.build.cache.size", 5)
+	if size <= 0 {
+		return nil
+	}
+	return &buildCache{
+		dir:    filepath.Join(appBinDir(logger), filepath.FromSlash(egret.ImportPath), "cache"),
+		size:   size,
+		logger: logger,
+		stamps: make(map[string]fileStamp),
+	}
+}
+
+// hash returns the hash of the app's sources and of the build settings.
+func (c *buildCache) hash(buildFlags []string) (string, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.version == "" {
+		out, err := exec.Command("go", "version").Output()
+		if err != nil {
+			return "", err
+		}
+		c.version = strings.TrimSpace(string(out))
+	}
+
+	h := sha256.New()
+	fmt.Fprintf(h, "%s\n%s\n%s\n", c.version, egret.ImportPath, runtime.GOOS+"/"+runtime.GOARCH)
+	fmt.Fprintf(h, "tags=%s\n", egret.Config.GetStringDefault("build.tags", ""))
+	fmt.Fprintf(h, "flags=%q\n", buildFlags)
+	fmt.Fprintf(h, "version=%s\n", getAppVersion(c.logger))
+	for _, name := range buildInputEnv {
+		fmt.Fprintf(h, "%s=%s\n", name, os.Getenv(name))
+	}
+
+	modRoot := findModuleRoot(egret.BasePath)
+	root := modRoot
+	if root == "" {
+		root = egret.BasePath
+	}
+	seen := make(map[string]bool)
+	if err := c.hashTree(h, root, root, true, seen); err != nil {
+		return "", err
+	}
+
+	// vendor/modules.txt identifies the vendored dependencies.
+	manifest := filepath.Join(root, "vendor", "modules.txt")
+	if info, err := os.Stat(manifest); err == nil {
+		fileHash, err := c.fileHash(manifest, info)
+		if err != nil {
+			return "", err
+		}
+		seen[manifest] = true
+		fmt.Fprintf(h, "vendor/modules.txt %s\n", fileHash)
+	}
+
+	// Dependencies whose sources may change along with the app's.
+	var deps []string
+	if modRoot != "" {
+		deps = localReplaces(modRoot)
+	} else {
+		dirs, err := gopathDeps(root)
+		if err != nil {
+			return "", err
+		}
+		deps = dirs
+	}
+	for _, dir := range deps {
+		fmt.Fprintf(h, "dependency %s\n", filepath.ToSlash(dir))
+		// A replaced module is a tree, a GOPATH package a single directory.
+		if err := c.hashTree(h, dir, dir, modRoot != "", seen); err != nil {
+			return "", err
+		}
+	}
+
+	// Forget about removed files.
+	for path := range c.stamps {
+		if !seen[path] {
+			delete(c.stamps, path)
+		}
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// hashTree writes the hashes of the build inputs in dir, and in its
+// subdirectories if recursive, to h, followed by those of the files they
+// embed.  Paths are written relative to root.
+func (c *buildCache) hashTree(h io.Writer, root, dir string, recursive bool, seen map[string]bool) error {
+	embeds := make(map[string][]string) // //go:embed patterns, by directory
+	err := filepath.Walk(dir, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		name := info.Name()
+		if info.IsDir() {
+			if path != dir && (!recursive || isHiddenDir(name) ||
+				name == "testdata" || name == "node_modules" || name == "vendor") {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if !isBuildInput(name) {
+			return nil
+		}
+		fileHash, err := c.fileHash(path, info)
+		if err != nil {
+			return err
+		}
+		seen[path] = true
+		rel, _ := filepath.Rel(root, path)
+		fmt.Fprintf(h, "%s %s\n", filepath.ToSlash(rel), fileHash)
+		if patterns := c.stamps[path].embeds; len(patterns) > 0 {
+			embeds[filepath.Dir(path)] = append(embeds[filepath.Dir(path)], patterns...)
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	dirs := make([]string, 0, len(embeds))
+	for dir := range embeds {
+		dirs = append(dirs, dir)
+	}
+	sort.Strings(dirs)
+	for _, dir := range dirs {
+		for _, pattern := range embeds[dir] {
+			if err := c.hashEmbed(h, root, dir, pattern, seen); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// hashEmbed writes the hashes of the files matching the //go:embed pattern
+// of a package in dir to h.  Directories are embedded whole.
+func (c *buildCache) hashEmbed(h io.Writer, root, dir, pattern string, seen map[string]bool) error {
+	matches, err := filepath.Glob(filepath.Join(dir, filepath.FromSlash(strings.TrimPrefix(pattern, "all:"))))
+	if err != nil {
+		// The compiler reports invalid patterns.
+		return nil
+	}
+	for _, match := range matches {
+		err := filepath.Walk(match, func(path string, info os.FileInfo, err error) error {
+			if err != nil || info.IsDir() {
+				return err
+			}
+			fileHash, err := c.fileHash(path, info)
+			if err != nil {
+				return err
+			}
+			seen[path] = true
+			rel, _ := filepath.Rel(root, path)
+			fmt.Fprintf(h, "embed %s %s\n", filepath.ToSlash(rel), fileHash)
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// embedPatterns returns the patterns of the //go:embed directives in the
+// source of a Go file.
+func embedPatterns(src []byte) []string {
+	var patterns []string
+	for _, line := range strings.Split(string(src), "\n") {
+		line = strings.TrimSpace(line)
+		if !strings.HasPrefix(line, "//go:embed ") {
+			continue
+		}
+		rest := strings.TrimSpace(strings.TrimPrefix(line, "//go:embed "))
+		for rest != "" {
+			// Patterns are space separated, or quoted if they contain spaces.
+			end := strings.IndexAny(rest, " \t")
+			if rest[0] == '"' || rest[0] == '`' {
+				if i := strings.IndexByte(rest[1:], rest[0]); i >= 0 {
+					end = i + 2
+				}
+			}
+			if end < 0 {
+				end = len(rest)
+			}
+			pattern := rest[:end]
+			if unquoted, err := strconv.Unquote(pattern); err == nil {
+				pattern = unquoted
+			}
+			patterns = append(patterns, pattern)
+			rest = strings.TrimSpace(rest[end:])
+		}
+	}
+	return patterns
+}
+
+// localReplaces returns the directories of the modules replaced by a local
+// directory in the go.mod file of modRoot.
+func localReplaces(modRoot string) []string {
+	data, err := ioutil.ReadFile(filepath.Join(modRoot, "go.mod"))
+	if err != nil {
+		return nil
+	}
+	var dirs []string
+	inBlock := false
+	for _, line := range strings.Split(string(data), "\n") {
+		if i := strings.Index(line, "//"); i >= 0 {
+			line = line[:i]
+		}
+		line = strings.TrimSpace(line)
+		switch {
+		case line == "replace (":
+			inBlock = true
+			continue
+		case inBlock && line == ")":
+			inBlock = false
+			continue
+		case strings.HasPrefix(line, "replace "):
+			line = strings.TrimPrefix(line, "replace ")
+		case !inBlock:
+			continue
+		}
+		i := strings.Index(line, "=>")
+		if i < 0 {
+			continue
+		}
+		target := strings.Fields(line[i+2:])
+		if len(target) != 1 {
+			// A module path and version, not a directory.
+			continue
+		}
+		dir := target[0]
+		if unquoted, err := strconv.Unquote(dir); err == nil {
+			dir = unquoted
+		}
+		if !filepath.IsAbs(dir) && !strings.HasPrefix(dir, "./") && !strings.HasPrefix(dir, "../") {
+			continue
+		}
+		if !filepath.IsAbs(dir) {
+			dir = filepath.Join(modRoot, dir)
+		}
+		if _, err := os.Stat(dir); err != nil {
+			// The build reports it.
+			continue
+		}
+		dirs = append(dirs, dir)
+	}
+	sort.Strings(dirs)
+	return dirs
+}
+
+// gopathDeps returns the directories of the packages the app imports from
+// GOPATH, outside of root, in GOPATH mode.
+func gopathDeps(root string) ([]string, error) {
+	cmd := exec.Command("go", "list", "-e", "-deps", "-f", "{{if not .Standard}}{{.Dir}}{{end}}", egret.ImportPath)
+	cmd.Dir = root
+	out, err := cmd.Output()
+	if err != nil {
+		return nil, fmt.Errorf("go list: %s", err)
+	}
+	var dirs []string
+	for _, dir := range strings.Split(string(out), "\n") {
+		dir = strings.TrimSpace(dir)
+		if rel, err := filepath.Rel(root, dir); dir == "" || err == nil && !strings.HasPrefix(rel, "..") {
+			continue
+		}
+		dirs = append(dirs, dir)
+	}
+	sort.Strings(dirs)
+	return dirs, nil
+}
+
+// isBuildInput reports whether a file of the given name affects the binary.
+func isBuildInput(name string) bool {
+	if name == "go.mod" || name == "go.sum" {
+		return true
+	}
+	if strings.HasSuffix(name, "_test.go") {
+		return false
+	}
+	switch filepath.Ext(name) {
+	case ".go", ".s", ".c", ".h", ".cc", ".cpp", ".syso":
+		return true
+	}
+	return false
+}
+
+// fileHash returns the hash of a file, reading it only if it changed since
+// it was last hashed.
+func (c *buildCache) fileHash(path string, info os.FileInfo) (string, error) {
+	if stamp, ok := c.stamps[path]; ok && stamp.size == info.Size() && stamp.modTime.Equal(info.ModTime()) {
+		return stamp.hash, nil
+	}
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return "", err
+	}
+	sum := sha256.Sum256(data)
+	stamp := fileStamp{size: info.Size(), modTime: info.ModTime(), hash: hex.EncodeToString(sum[:])}
+	if strings.HasSuffix(path, ".go") {
+		stamp.embeds = embedPatterns(data)
+	}
+	c.stamps[path] = stamp
+	return stamp.hash, nil
+}
+
+// path returns where the binary built from hash is cached.
+func (c *buildCache) path(hash string) string {
+	name := hash
+	if runtime.GOOS == "windows" {
+		name += ".exe"
+	}
+	return filepath.Join(c.dir, name)
+}
+
+// lookup returns the cached binary built from hash, or an empty string.
+func (c *buildCache) lookup(hash string) string {
+	path := c.path(hash)
+	if _, err := os.Stat(path); err != nil {
+		return ""
+	}
+	// Mark it as recently used.
+	now := time.Now()
+	os.Chtimes(path, now, now)
+	return path
+}
+
+// store copies the binary built from hash into the cache, evicting the least
+// recently used binaries over the cache size.  It returns the cached path.
+func (c *buildCache) store(hash, binPath string) (string, error) {
+	if err := os.MkdirAll(c.dir, 0777); err != nil {
+		return "", err
+	}
+	path := c.path(hash)
+	tmp := path + ".tmp"
+	if err := copyFile(tmp, binPath); err != nil {
+		os.Remove(tmp)
+		return "", err
+	}
+	if err := os.Rename(tmp, path); err != nil {
+		os.Remove(tmp)
+		return "", err
+	}
+	c.evict()
+	return path, nil
+}
+
+// evict removes the least recently used binaries over the cache size.
+func (c *buildCache) evict() {
+	infos, err := ioutil.ReadDir(c.dir)
+	if err != nil {
+		return
+	}
+	sort.Slice(infos, func(i, j int) bool {
+		return infos[i].ModTime().After(infos[j].ModTime())
+	})
+	for i, info := range infos {
+		if i >= c.size {
+			if err := os.Remove(filepath.Join(c.dir, info.Name())); err != nil {
+				c.logger.Warn("Failed to evict cached build", zap.String("file", info.Name()), zap.Error(err))
+			}
+		}
+	}
+}
+
+func copyFile(dest, src string) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	out, err := os.OpenFile(dest, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0755)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(out, in); err != nil {
+		out.Close()
+		return err
+	}
+	return out.Close()
+}
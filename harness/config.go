@@ -0,0 +1,154 @@
+package harness
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+
+	"go.uber.org/zap"
+	"gopkg.in/yaml.v2"
+
+	"github.com/kenorld/egret-core"
+)
+
+// configMu guards the egret.* globals, which reloadConfig sets again, against
+// the goroutines serving requests and watching files.  They hold it only
+// while reading them, never while proxying.
+var configMu sync.RWMutex
+
+// yamlErrorLinePattern extracts the line number from a YAML syntax error.
+var yamlErrorLinePattern = regexp.MustCompile(`line (\d+)`)
+
+// listenConfig is the part of the configuration the harness listens with.
+type listenConfig struct {
+	addr string
+	port int
+	tls  bool
+	cert string
+	key  string
+}
+
+func currentListenConfig() listenConfig {
+	return listenConfig{
+		addr: egret.HttpAddr,
+		port: egret.HttpPort,
+		tls:  egret.HttpTLSEnabled,
+		cert: egret.HttpTLSCert,
+		key:  egret.HttpTLSKey,
+	}
+}
+
+// confDir returns the app's configuration directory.
+func confDir() string {
+	return filepath.Join(egret.BasePath, "conf")
+}
+
+// isConfFile reports whether filename is part of the app's configuration.
+func isConfFile(filename string) bool {
+	rel, err := filepath.Rel(confDir(), filename)
+	if err != nil || strings.HasPrefix(rel, "..") {
+		return false
+	}
+	return !strings.HasPrefix(filepath.Base(filename), ".")
+}
+
+// reloadConfig re-reads the app's configuration for the current run mode.
+// The harness settings taken from it are applied, and the listener is
+// restarted if its address, port or TLS settings changed.  The app itself
+// picks up the new configuration when it is restarted.
+func (h *Harness) reloadConfig() *egret.Error {
+	if err := validateConfig(); err != nil {
+		return err
+	}
+
+	h.logger.Info("Reloading configuration...", zap.String("mode", egret.RunMode))
+	before := currentListenConfig()
+	configMu.Lock()
+	egret.Init(egret.RunMode, egret.ImportPath, "")
+	egret.LoadMimeConfig()
+	if h.httpPort != 0 {
+		egret.HttpPort = h.httpPort
+	}
+	configMu.Unlock()
+
+	watch, err := newWatchConfig()
+	if err != nil {
+		return configError(err)
+	}
+	restartPolicy, err := newRestartPolicy()
+	if err != nil {
+		return configError(err)
+	}
+	hooks, err := newBuildHooks()
+	if err != nil {
+		return configError(err)
+	}
+	assets, err := NewAssets(h.logger)
+	if err != nil {
+		return configError(err)
+	}
+	routes, err := newProxyRoutes(h.logger)
+	if err != nil {
+		return configError(err)
+	}
+	h.mu.Lock()
+	h.watch = watch
+	h.restartPolicy = restartPolicy
+	h.hooks = hooks
+	h.assets = assets
+	h.routes = routes
+	h.hold = egret.Config.GetBoolDefault("harness.rebuild.hold", false)
+	h.mu.Unlock()
+
+	if currentListenConfig() != before {
+		h.logger.Info("Listen settings changed, restarting the listener")
+		if err := h.listen(); err != nil {
+			// The previous listener keeps serving, if it could be kept.
+			h.logger.Error("Cannot listen", zap.Error(err))
+			return configError(fmt.Errorf("Cannot listen with the new settings: %s", err))
+		}
+	}
+	return nil
+}
+
+// configError returns an Error showing an invalid configuration.
+func configError(err error) *egret.Error {
+	return &egret.Error{
+		Name:    "config_error",
+		Title:   "Configuration Error",
+		Summary: err.Error(),
+	}
+}
+
+// validateConfig checks that the YAML files in the conf directory parse, so
+// that a typo is reported on the error page rather than stopping the harness.
+func validateConfig() *egret.Error {
+	files, _ := filepath.Glob(filepath.Join(confDir(), "*.y*ml"))
+	for _, filename := range files {
+		data, err := ioutil.ReadFile(filename)
+		if err != nil {
+			if os.IsNotExist(err) {
+				continue
+			}
+			e := configError(err)
+			e.Path = filename
+			return e
+		}
+		var v map[string]interface{}
+		if err := yaml.Unmarshal(data, &v); err != nil {
+			e := configError(fmt.Errorf("%s: %s", filepath.Base(filename), err))
+			e.SourceType, e.Path = "configuration", filename
+			if m := yamlErrorLinePattern.FindStringSubmatch(err.Error()); m != nil {
+				e.Line, _ = strconv.Atoi(m[1])
+				e.SourceLines = strings.Split(string(data), "\n")
+			}
+			return e
+		}
+	}
+	return nil
+}
@@ -0,0 +1,118 @@
+package harness
+
+import (
+	"fmt"
+	"time"
+
+	"go.uber.org/zap"
+
+	"github.com/kenorld/egret-core"
+)
+
+// crashResetAfter is how long the app must have run for a crash not to count
+// as one more in a row.
+const crashResetAfter = time.Minute
+
+// restartPolicy decides whether the app is restarted when it exits on its
+// own, as set by:
+//
+//	harness.restart.policy       never, on-failure (the default) or always
+//	harness.restart.backoff      delay before restarting after a first crash
+//	                             (1s), doubled for each crash in a row
+//	harness.restart.backoff.max  longest delay (30s)
+//	harness.restart.max          crashes in a row after which the app is left
+//	                             down until the next change (5, 0 for no limit)
+type restartPolicy struct {
+	mode       string
+	backoff    time.Duration
+	maxBackoff time.Duration
+	max        int
+}
+
+func newRestartPolicy() (*restartPolicy, error) {
+	p := &restartPolicy{
+		mode: egret.Config.GetStringDefault("harness.restart.policy", "on-failure"),
+		max:  egret.Config.GetIntDefault("harness.restart.max", 5),
+	}
+	switch p.mode {
+	case "never", "on-failure", "always":
+	default:
+		return nil, fmt.Errorf("harness.restart.policy: unknown policy %q", p.mode)
+	}
+	var err error
+	if p.backoff, err = time.ParseDuration(egret.Config.GetStringDefault("harness.restart.backoff", "1s")); err != nil {
+		return nil, fmt.Errorf("harness.restart.backoff: %s", err)
+	}
+	if p.maxBackoff, err = time.ParseDuration(egret.Config.GetStringDefault("harness.restart.backoff.max", "30s")); err != nil {
+		return nil, fmt.Errorf("harness.restart.backoff.max: %s", err)
+	}
+	return p, nil
+}
+
+// delay returns how long to wait before restarting after the given number of
+// crashes in a row.
+func (p *restartPolicy) delay(crashes int) time.Duration {
+	d := p.backoff
+	for i := 1; i < crashes && d < p.maxBackoff; i++ {
+		d *= 2
+	}
+	if d > p.maxBackoff {
+		d = p.maxBackoff
+	}
+	return d
+}
+
+// crashed applies the restart policy once the app exited on its own, with
+// success telling whether it exited cleanly, after running for uptime (zero
+// if it failed to start up).  It returns the error to show until the app is
+// back up.
+func (h *Harness) crashed(err *egret.Error, success bool, uptime time.Duration) *egret.Error {
+	h.mu.Lock()
+	p := h.restartPolicy
+	h.mu.Unlock()
+	if p.mode == "never" || (p.mode == "on-failure" && success) {
+		return err
+	}
+
+	h.mu.Lock()
+	if uptime > crashResetAfter {
+		h.crashes = 0
+	}
+	h.crashes++
+	crashes := h.crashes
+	h.mu.Unlock()
+
+	if p.max > 0 && crashes > p.max {
+		h.logger.Error("App keeps crashing, not restarting it until the next change", zap.Int("crashes", crashes))
+		loop := *err
+		loop.Name = "app_crash_loop"
+		loop.Title = "App keeps crashing"
+		loop.Summary = fmt.Sprintf("The app crashed %d times in a row, it won't be restarted until the next change. Last crash: %s",
+			crashes, err.Summary)
+		return &loop
+	}
+
+	delay := p.delay(crashes)
+	h.logger.Warn("Restarting the app", zap.Duration("in", delay), zap.Int("crashes", crashes))
+	time.AfterFunc(delay, func() {
+		// Skip the restart if the app was rebuilt or crashed again meanwhile.
+		h.mu.Lock()
+		stale := h.crashes != crashes
+		h.mu.Unlock()
+		if !stale {
+			h.schedule(actionRestart)
+		}
+	})
+
+	restarting := *err
+	restarting.Summary += fmt.Sprintf(" Restarting in %s (crash %d in a row).", delay, crashes)
+	return &restarting
+}
+
+// resetCrashes forgets about earlier crashes, when the app is rebuilt or
+// restarted on request.
+func (h *Harness) resetCrashes() {
+	h.mu.Lock()
+	h.crashes = 0
+	h.mu.Unlock()
+}
@@ -0,0 +1,48 @@
+package harness
+
+import (
+	"fmt"
+	"os/exec"
+
+	"github.com/kenorld/egret-core"
+)
+
+// DebugBuildFlags disable optimizations and inlining, so that the app can be
+// stepped through in a debugger.
+var DebugBuildFlags = []string{"-gcflags", "all=-N -l"}
+
+// Delve runs the app under a headless Delve session, which IDEs attach to.
+type Delve struct {
+	Path string // dlv executable
+	Addr string // address the debugger listens on
+}
+
+// NewDelve method finds dlv, and returns a session listening on the given
+// port, or on harness.debug.port (2345 by default) if zero.  The address is
+// set by harness.debug.addr, localhost by default.
+func NewDelve(port int) (*Delve, error) {
+	path, err := exec.LookPath("dlv")
+	if err != nil {
+		return nil, fmt.Errorf("dlv not found, install it with \"go install github.com/go-delve/delve/cmd/dlv@latest\": %s", err)
+	}
+	if port == 0 {
+		port = egret.Config.GetIntDefault("harness.debug.port", 2345)
+	}
+	addr := egret.Config.GetStringDefault("harness.debug.addr", "127.0.0.1")
+	return &Delve{Path: path, Addr: fmt.Sprintf("%s:%d", addr, port)}, nil
+}
+
+// wrap rewrites cmd to run the app under Delve.  The app starts right away,
+// and the debugger keeps accepting clients for as long as it runs.
+func (d *Delve) wrap(cmd *AppCmd) {
+	args := []string{d.Path, "exec", cmd.Path,
+		"--headless",
+		"--listen=" + d.Addr,
+		"--api-version=2",
+		"--accept-multiclient",
+		"--continue",
+		"--"}
+	cmd.Args = append(args, cmd.Args[1:]...)
+	cmd.Path = d.Path
+	cmd.debug = true
+}
@@ -0,0 +1,192 @@
+package harness
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"go.uber.org/zap"
+
+	"github.com/kenorld/egret-core"
+)
+
+// envFiles returns the env files loaded for the app, in the order they are
+// applied: ".env" and then ".env.<run mode>", from the app's base path.
+func envFiles() []string {
+	return []string{
+		filepath.Join(egret.BasePath, ".env"),
+		filepath.Join(egret.BasePath, ".env."+egret.RunMode),
+	}
+}
+
+// appEnv returns the environment the app is run with.
+//
+// The environment of egret itself is inherited, filtered by harness.env.allow
+// (only variables matching these globs are passed, all of them if empty) and
+// harness.env.deny (variables matching these globs are not passed).
+// Variables from the env files are added to it, without overriding inherited
+// ones unless harness.env.override is set.
+func appEnv(logger *zap.Logger) []string {
+	allow := configList("harness.env.allow", "")
+	deny := configList("harness.env.deny", "")
+	override := egret.Config.GetBoolDefault("harness.env.override", false)
+
+	env := make(map[string]string)
+	var filtered []string
+	for _, kv := range os.Environ() {
+		name, value := splitEnv(kv)
+		if !envAllowed(name, allow, deny) {
+			filtered = append(filtered, name)
+			continue
+		}
+		env[name] = value
+	}
+	inherited := make(map[string]bool, len(env))
+	for name := range env {
+		inherited[name] = true
+	}
+
+	var loaded, injected []string
+	seen := make(map[string]bool)
+	for _, filename := range envFiles() {
+		vars, err := parseEnvFile(filename)
+		if err != nil {
+			if !os.IsNotExist(err) {
+				logger.Error("Failed to load env file", zap.String("file", filename), zap.Error(err))
+			}
+			continue
+		}
+		loaded = append(loaded, filepath.Base(filename))
+		for _, v := range vars {
+			if inherited[v[0]] && !override {
+				continue
+			}
+			env[v[0]] = v[1]
+			if !seen[v[0]] {
+				seen[v[0]] = true
+				injected = append(injected, v[0])
+			}
+		}
+	}
+
+	if len(loaded) > 0 || len(filtered) > 0 {
+		logger.Info("App environment",
+			zap.Strings("files", loaded),
+			zap.Strings("injected", injected),
+			zap.Strings("filtered", filtered))
+	}
+
+	list := make([]string, 0, len(env))
+	for name, value := range env {
+		list = append(list, name+"="+value)
+	}
+	sort.Strings(list)
+	return list
+}
+
+// envAllowed reports whether the inherited variable name is passed to the app.
+func envAllowed(name string, allow, deny []string) bool {
+	for _, pattern := range deny {
+		if ok, _ := path.Match(pattern, name); ok {
+			return false
+		}
+	}
+	if len(allow) == 0 {
+		return true
+	}
+	for _, pattern := range allow {
+		if ok, _ := path.Match(pattern, name); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// parseEnvFile reads the NAME=value pairs of an env file, in order.
+// Blank lines and lines starting with # are skipped, and a leading "export"
+// is ignored.  Values may be single quoted (taken literally) or double quoted
+// (with \n, \t, \" and \\ escapes); unquoted values end at " #".
+func parseEnvFile(filename string) ([][2]string, error) {
+	f, err := os.Open(filename)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var vars [][2]string
+	scanner := bufio.NewScanner(f)
+	for n := 1; scanner.Scan(); n++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		line = strings.TrimSpace(strings.TrimPrefix(line, "export "))
+		i := strings.Index(line, "=")
+		if i <= 0 {
+			return nil, fmt.Errorf("%s:%d: expected NAME=value", filename, n)
+		}
+		name := strings.TrimSpace(line[:i])
+		value, err := parseEnvValue(strings.TrimSpace(line[i+1:]))
+		if err != nil {
+			return nil, fmt.Errorf("%s:%d: %s", filename, n, err)
+		}
+		vars = append(vars, [2]string{name, value})
+	}
+	return vars, scanner.Err()
+}
+
+func parseEnvValue(s string) (string, error) {
+	if s == "" {
+		return "", nil
+	}
+	switch s[0] {
+	case '\'':
+		end := strings.Index(s[1:], "'")
+		if end < 0 {
+			return "", fmt.Errorf("unterminated quote")
+		}
+		return s[1 : end+1], nil
+	case '"':
+		var b strings.Builder
+		for i := 1; i < len(s); i++ {
+			switch c := s[i]; {
+			case c == '"':
+				return b.String(), nil
+			case c == '\\' && i+1 < len(s):
+				i++
+				switch s[i] {
+				case 'n':
+					b.WriteByte('\n')
+				case 't':
+					b.WriteByte('\t')
+				default:
+					b.WriteByte(s[i])
+				}
+			default:
+				b.WriteByte(c)
+			}
+		}
+		return "", fmt.Errorf("unterminated quote")
+	}
+	if i := strings.Index(s, " #"); i >= 0 {
+		s = s[:i]
+	}
+	return strings.TrimSpace(s), nil
+}
+
+// splitEnv splits a NAME=value pair of the environment.  On Windows, names
+// may start with "=".
+func splitEnv(kv string) (string, string) {
+	start := 0
+	if strings.HasPrefix(kv, "=") {
+		start = 1
+	}
+	if i := strings.Index(kv[start:], "="); i >= 0 {
+		return kv[:start+i], kv[start+i+1:]
+	}
+	return kv, ""
+}
@@ -0,0 +1,144 @@
+package harness
+
+import (
+	"encoding/json"
+	"fmt"
+	"html/template"
+	"io"
+	"net/http"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/kenorld/egret-core"
+)
+
+// compileErrorPattern matches "file:line:col: message" lines of "go build" output.
+var compileErrorPattern = regexp.MustCompile(`^((?:[A-Za-z]:)?[^:#\s][^:]*):(\d+)(?::(\d+))?: (.*)$`)
+
+// excerptLines is the number of source lines shown around a compile error.
+const excerptLines = 3
+
+// CompileError is a single error reported by the Go compiler.
+type CompileError struct {
+	File    string       `json:"file"`
+	Line    int          `json:"line"`
+	Column  int          `json:"column,omitempty"`
+	Message string       `json:"message"`
+	Source  []SourceLine `json:"source,omitempty"`
+}
+
+// SourceLine is a line of the source excerpt shown with a CompileError.
+type SourceLine struct {
+	Number  int    `json:"number"`
+	Text    string `json:"text"`
+	IsError bool   `json:"isError,omitempty"`
+}
+
+func (e CompileError) String() string {
+	if e.Column > 0 {
+		return fmt.Sprintf("%s:%d:%d: %s", e.File, e.Line, e.Column, e.Message)
+	}
+	return fmt.Sprintf("%s:%d: %s", e.File, e.Line, e.Message)
+}
+
+// parseCompileErrors extracts every error from the output of "go build".
+// Relative file names are resolved against dir, the directory the build ran in.
+// Indented lines following an error are continuations of its message.
+func parseCompileErrors(output []byte, dir string) []CompileError {
+	var errs []CompileError
+	for _, line := range strings.Split(string(output), "\n") {
+		line = strings.TrimRight(line, "\r")
+		if m := compileErrorPattern.FindStringSubmatch(line); m != nil {
+			lineNum, _ := strconv.Atoi(m[2])
+			col, _ := strconv.Atoi(m[3])
+			errs = append(errs, CompileError{
+				File:    m[1],
+				Line:    lineNum,
+				Column:  col,
+				Message: m[4],
+			})
+			continue
+		}
+		if len(errs) > 0 && strings.HasPrefix(line, "\t") {
+			errs[len(errs)-1].Message += "\n" + strings.TrimSpace(line)
+		}
+	}
+
+	for i := range errs {
+		absFilename := errs[i].File
+		if !filepath.IsAbs(absFilename) {
+			absFilename = filepath.Join(dir, absFilename)
+		}
+		if lines, err := egret.ReadLines(absFilename); err == nil {
+			errs[i].Source = excerpt(lines, errs[i].Line)
+		}
+	}
+	return errs
+}
+
+// excerpt returns the source lines around line (1-based).
+func excerpt(lines []string, line int) []SourceLine {
+	var source []SourceLine
+	for n := line - excerptLines; n <= line+excerptLines; n++ {
+		if n < 1 || n > len(lines) {
+			continue
+		}
+		source = append(source, SourceLine{Number: n, Text: lines[n-1], IsError: n == line})
+	}
+	return source
+}
+
+var compileErrorsTemplate = template.Must(template.New("compile_errors").Parse(`<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<title>Go Compilation Error</title>
+<style>
+body { font-family: sans-serif; margin: 0; }
+h1 { background: #c33; color: #fff; margin: 0; padding: 16px; font-size: 20px; }
+.error { border-bottom: 1px solid #ddd; padding: 12px 16px; }
+.file { font-family: monospace; color: #555; }
+.message { font-weight: bold; white-space: pre-wrap; margin: 6px 0; }
+pre { background: #f6f6f6; margin: 0; padding: 6px 0; }
+pre span { display: block; padding: 0 8px; }
+pre span.error-line { background: #fdd; }
+</style>
+</head>
+<body>
+<h1>Go Compilation Error ({{len .}})</h1>
+{{range .}}<div class="error">
+<div class="file">{{.File}}:{{.Line}}{{if .Column}}:{{.Column}}{{end}}</div>
+<div class="message">{{.Message}}</div>
+{{if .Source}}<pre>{{range .Source}}<span{{if .IsError}} class="error-line"{{end}}>{{printf "%4d" .Number}}  {{.Text}}</span>{{end}}</pre>{{end}}
+</div>
+{{end}}</body>
+</html>
+`))
+
+// renderCompileErrors writes every compile error, as JSON if the client asks
+// for it and as an HTML page otherwise.
+func renderCompileErrors(w http.ResponseWriter, r *http.Request, errs []CompileError) {
+	if strings.Contains(r.Header.Get("Accept"), "application/json") {
+		w.Header().Set("Content-Type", "application/json; charset=utf-8")
+		w.WriteHeader(http.StatusInternalServerError)
+		json.NewEncoder(w).Encode(struct {
+			Errors []CompileError `json:"errors"`
+		}{errs})
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.WriteHeader(http.StatusInternalServerError)
+	compileErrorsTemplate.Execute(w, errs)
+}
+
+// printCompileErrors lists compile errors, as logged after a failed build.
+func printCompileErrors(w io.Writer, errs []CompileError) {
+	fmt.Fprintf(w, "\n%d Go compilation error(s):\n", len(errs))
+	for _, e := range errs {
+		fmt.Fprintf(w, "  %s\n", strings.Replace(e.String(), "\n", "\n    ", -1))
+	}
+	fmt.Fprintln(w)
+}
@@ -21,31 +21,96 @@ import (
 	"os/signal"
 	"path/filepath"
 	"strings"
+	"sync"
 	"sync/atomic"
+	"syscall"
+	"time"
 
 	"go.uber.org/zap"
+	"golang.org/x/net/http2"
+	"golang.org/x/net/http2/h2c"
 
 	"github.com/kenorld/egret-core"
 )
 
 var (
-	watcher    *egret.Watcher
-	doNotWatch = []string{"views"}
+	watcher *egret.Watcher
 
 	lastRequestHadError int32
 )
 
+// startUpWarning is the source of the warning shown when a new build fails to
+// start up while the previous one keeps serving.
+const startUpWarning = "start_up"
+
+// sanitizerWarning is the source of the warning showing the reports of the
+// race detector and sanitizers, printed by the app while it keeps serving.
+const sanitizerWarning = "sanitizer"
+
 // Harness reverse proxies requests to the application server.
 // It builds / runs / rebuilds / restarts the server when code is changed.
 type Harness struct {
-	app        *App
-	serverHost string
-	port       int
-	proxy      *httputil.ReverseProxy
-	logger     *zap.Logger
+	// BuildFlags are passed to "go build", e.g. -race.
+	BuildFlags []string
+
+	// Debug, if set, builds the app without optimizations and runs it under
+	// Delve.  Instances are then replaced rather than run side by side, as
+	// they share the debugger's address.
+	Debug *Delve
+
+	httpPort int // overrides http.port from the configuration, if not zero
+
+	app    *App
+	port   int
+	target atomic.Value // *url.URL of the app instance currently serving
+	proxy  *httputil.ReverseProxy
+	reload *liveReload
+	logger *zap.Logger
+
+	inspector *inspector  // recent requests, nil if disabled
+	cache     *buildCache // binaries built before, nil if disabled
+	views     *viewSet    // templates changed since they were last valid
+
+	restartPolicy *restartPolicy // what to do when the app exits on its own
+	hooks         *buildHooks    // commands run around "go build"
+	assets        *Assets        // asset pipeline, nil if no bundles are configured
+	routes        []*proxyRoute  // path prefixes forwarded to other upstreams
+
+	watch         *watchConfig
+	watchConf     bool  // restart the app when its configuration changes
+	changeAction  int32 // most expensive action required by the changes seen
+	configChanged int32 // 1 if the configuration changed since it was last loaded
+	forceBuild    int32 // 1 if the next rebuild must not be skipped or taken from the build cache
+
+	hold          bool          // hold API requests until a rebuild is done
+	pending       chan struct{} // queued rebuild
+	pendingAction int32         // most expensive action queued
+	lastChange    int64         // unix nanoseconds of the last change event
+	admin         *http.ServeMux
+
+	mu        sync.Mutex
+	building  bool          // a rebuild is queued or in progress
+	ready     chan struct{} // closed when the current rebuild is done
+	lastError *egret.Error  // error returned by the last rebuild
+	crashes   int           // crashes in a row since the last change
+	server    *http.Server  // listener for the proxy
+	reserved  net.Listener  // holds port until the app is first started
+
+	compileErrors []CompileError // every compile error of the last rebuild
+	lastBuild     buildInfo
+	warnings      map[string]*egret.Error // errors the app keeps serving despite, by source
+}
+
+// buildInfo describes the last build of the app.
+type buildInfo struct {
+	Started  time.Time
+	Duration time.Duration
+	Failed   bool
 }
 
 func renderError(w http.ResponseWriter, r *http.Request, err error) {
+	configMu.RLock()
+	defer configMu.RUnlock()
 	req, resp := egret.NewRequest(r), egret.NewResponse(w)
 	c := egret.NewContext(req, resp)
 	c.RenderError(err)
@@ -60,12 +125,47 @@ func (h *Harness) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	// Flush any change events and rebuild app if necessary.
+	// Reserved harness routes.
+	if isAdminPath(r.URL.Path) {
+		h.admin.ServeHTTP(w, r)
+		return
+	}
+
+	// Other upstreams don't depend on the app being up.
+	h.mu.Lock()
+	route := matchRoute(h.routes, r.URL.Path)
+	h.mu.Unlock()
+	if route != nil {
+		if h.inspector != nil {
+			var done func()
+			w, r, done = h.inspector.record(w, r)
+			defer done()
+		}
+		route.handler.ServeHTTP(w, r)
+		return
+	}
+
+	// Rebuilds happen in the background.  Hold off requests made while
+	// there is nothing healthy to serve them.
+	if !h.waitForBuild(w, r) {
+		return
+	}
+
 	// Render an error page if the rebuild / restart failed.
-	err := watcher.Notify()
+	h.mu.Lock()
+	err, compileErrors := h.lastError, h.compileErrors
+	h.mu.Unlock()
 	if err != nil {
 		atomic.CompareAndSwapInt32(&lastRequestHadError, 0, 1)
-		renderError(w, r, err)
+		if len(compileErrors) > 0 {
+			renderCompileErrors(w, r, compileErrors)
+		} else {
+			renderError(w, r, err)
+		}
+		// Let the error page reload itself once the app is fixed.
+		if h.reload != nil && isHTMLRequest(r) {
+			io.WriteString(w, liveReloadScript)
+		}
 		return
 	}
 	atomic.CompareAndSwapInt32(&lastRequestHadError, 1, 0)
@@ -73,23 +173,107 @@ func (h *Harness) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	// Reverse proxy the request.
 	// (Need special code for websockets, courtesy of bradfitz)
 	if strings.EqualFold(r.Header.Get("Upgrade"), "websocket") {
-		proxyWebsocket(w, r, h.serverHost, h.logger)
-	} else {
-		h.proxy.ServeHTTP(w, r)
+		target := h.target.Load().(*url.URL)
+		proxyWebsocket(w, r, target.Scheme == "https", target.Host, h.logger)
+		return
 	}
+
+	if h.inspector != nil {
+		var done func()
+		w, r, done = h.inspector.record(w, r)
+		defer done()
+	}
+	h.proxy.ServeHTTP(w, r)
 }
 
 // NewHarness method returns a reverse proxy that forwards requests
-// to the given port.
-func NewHarness(logger *zap.Logger) *Harness {
+// to the app.  httpPort, if not zero, overrides http.port from the
+// configuration, also when it is reloaded.
+func NewHarness(logger *zap.Logger, httpPort int) *Harness {
+	if httpPort != 0 {
+		egret.HttpPort = httpPort
+	}
+
 	// Get a template loader to render errors.
 	// Prefer the app's views/errors directory, and fall back to the stock error pages.
 	// egret.MainTemplateLoader = egret.NewTemplateLoader(
 	// 	[]string{filepath.Join(egret.EgretPath, "views")})
 	// egret.MainTemplateLoader.Refresh()
 
+	port, reserved, err := reservePort(egret.Config.GetIntDefault("harness.port", 0))
+	if err != nil {
+		logger.Fatal("Cannot reserve the app's port", zap.Error(err))
+	}
+
+	watch, err := newWatchConfig()
+	if err != nil {
+		logger.Fatal("Invalid watch configuration", zap.Error(err))
+	}
+	restartPolicy, err := newRestartPolicy()
+	if err != nil {
+		logger.Fatal("Invalid restart policy", zap.Error(err))
+	}
+	hooks, err := newBuildHooks()
+	if err != nil {
+		logger.Fatal("Invalid build hooks", zap.Error(err))
+	}
+	assets, err := NewAssets(logger)
+	if err != nil {
+		logger.Fatal("Invalid asset pipeline configuration", zap.Error(err))
+	}
+	routes, err := newProxyRoutes(logger)
+	if err != nil {
+		logger.Fatal("Invalid proxy routes", zap.Error(err))
+	}
+
+	harness := &Harness{
+		port:          port,
+		httpPort:      httpPort,
+		reserved:      reserved,
+		watch:         watch,
+		watchConf:     egret.Config.GetBoolDefault("watch.conf", true),
+		logger:        logger,
+		hold:          egret.Config.GetBoolDefault("harness.rebuild.hold", false),
+		restartPolicy: restartPolicy,
+		hooks:         hooks,
+		assets:        assets,
+		routes:        routes,
+		pending:       make(chan struct{}, 1),
+		views:         newViewSet(),
+		cache:         newBuildCache(logger),
+		warnings:      make(map[string]*egret.Error),
+	}
+	harness.setTarget(port)
+	harness.proxy = &httputil.ReverseProxy{
+		Director:     harness.director,
+		Transport:    newProtocolTransport(egret.Config.GetStringDefault("harness.proxy.http2", "auto")),
+		ErrorHandler: harness.proxyError,
+		// Flush immediately, so that streaming responses (SSE, gRPC) get through.
+		FlushInterval: -1,
+	}
+
+	if egret.Config.GetBoolDefault("harness.livereload", true) {
+		harness.reload = newLiveReload(logger)
+		harness.proxy.ModifyResponse = injectScript
+	}
+	if egret.Config.GetBoolDefault("harness.inspector.enabled", true) {
+		// A size of 0 disables the inspector.
+		size := egret.Config.GetIntDefault("harness.inspector.size", 100)
+		if size < 0 {
+			logger.Fatal("Invalid inspector configuration", zap.Int("harness.inspector.size", size))
+		}
+		if size > 0 {
+			harness.inspector = newInspector(size,
+				egret.Config.GetIntDefault("harness.inspector.body.limit", 64*1024))
+		}
+	}
+	harness.admin = harness.adminHandler()
+	return harness
+}
+
+// setTarget points the reverse proxy at the app instance listening on port.
+func (h *Harness) setTarget(port int) {
 	addr := egret.HttpAddr
-	port := egret.Config.GetIntDefault("harness.port", 0)
 	scheme := "http"
 	if egret.HttpTLSEnabled {
 		scheme = "https"
@@ -100,61 +284,372 @@ func NewHarness(logger *zap.Logger) *Harness {
 		addr = "localhost"
 	}
 
-	if port == 0 {
-		port = getFreePort(logger)
+	serverURL, _ := url.ParseRequestURI(fmt.Sprintf(scheme+"://%s:%d", addr, port))
+	h.target.Store(serverURL)
+}
+
+// director rewrites proxied requests to the app instance currently serving.
+func (h *Harness) director(req *http.Request) {
+	target := h.target.Load().(*url.URL)
+	setProxyTarget(req, target.Scheme, target.Host)
+}
+
+// Refresh method is called by the watcher when the app's code changed.
+// It schedules the action required by the changes in the background and
+// returns immediately.
+func (h *Harness) Refresh() *egret.Error {
+	action := atomic.SwapInt32(&h.changeAction, actionNone)
+	if action == actionNone {
+		// Initial refresh, not caused by a change.
+		action = actionRebuild
 	}
+	h.resetCrashes()
+	h.schedule(action)
+	return nil
+}
 
-	serverURL, _ := url.ParseRequestURI(fmt.Sprintf(scheme+"://%s:%d", addr, port))
+// refresh rebuilds the Egret application and runs it next to the
+// instance currently serving, switching over once the new one is up.
+// Nothing is rebuilt if the sources are those of the running binary, or of
+// one in the build cache, unless the rebuild is forced.
+func (h *Harness) refresh() *egret.Error {
+	force := atomic.SwapInt32(&h.forceBuild, 0) == 1
 
-	harness := &Harness{
-		port:       port,
-		serverHost: serverURL.String()[len(scheme+"://"):],
-		proxy:      httputil.NewSingleHostReverseProxy(serverURL),
-		logger:     logger,
+	flags := append([]string(nil), h.BuildFlags...)
+	if h.Debug != nil {
+		flags = append(flags, DebugBuildFlags...)
 	}
 
-	if egret.HttpTLSEnabled {
-		harness.proxy.Transport = &http.Transport{
-			TLSClientConfig: &tls.Config{InsecureSkipVerify: true},
-		}
+	// The pre-build hooks may generate sources, so they run before hashing.
+	h.mu.Lock()
+	hooks := h.hooks
+	h.mu.Unlock()
+	started := time.Now()
+	if err := hooks.run("pre", h.logger); err != nil {
+		h.setBuild(started, true, nil)
+		return err
 	}
-	return harness
-}
+	// The asset bundles are built next, as the hooks may generate their
+	// sources too, so that they are ready when the app starts.
+	urlsChanged, _ := h.buildAssets()
 
-// Refresh method rebuilds the Egret application and run it on the given port.
-func (h *Harness) Refresh() (err *egret.Error) {
-	if h.app != nil {
-		h.app.Kill()
+	var hash string
+	if h.cache != nil {
+		var err error
+		if hash, err = h.cache.hash(flags); err != nil {
+			h.logger.Warn("Failed to hash the sources, not using the build cache", zap.Error(err))
+		}
+	}
+	if hash != "" && !force {
+		h.mu.Lock()
+		current, lastError := h.app, h.lastError
+		h.mu.Unlock()
+		if current != nil && current.hash == hash {
+			h.setBuild(time.Now(), false, nil)
+			if !urlsChanged && (lastError == nil || lastError.Name == "compilation_error") {
+				h.logger.Info("Sources unchanged, skipping rebuild")
+				return nil
+			}
+			// The binary is fine, but it crashed or has to read the new
+			// asset manifest: run it again.
+			app := h.cachedApp(current.BinaryPath, hash)
+			app.buildDir = current.buildDir
+			return h.start(app)
+		}
+		if binPath := h.cache.lookup(hash); binPath != "" {
+			h.logger.Info("Using cached build", zap.String("binary", binPath))
+			h.setBuild(time.Now(), false, nil)
+			return h.start(h.cachedApp(binPath, hash))
+		}
 	}
 
 	h.logger.Info("Rebuilding...")
-	h.app, err = Build(h.logger)
+	app, err, compileErrors := buildApp(h.logger, flags)
 	if err != nil {
-		return
+		h.setBuild(started, true, compileErrors)
+		return err
+	}
+	if err := hooks.run("post", h.logger); err != nil {
+		h.setBuild(started, true, nil)
+		app.removeBuild()
+		return err
+	}
+	h.setBuild(started, false, nil)
+	if hash != "" {
+		// Run the cached copy, so the next build can replace the binary
+		// while this one is running.
+		if binPath, err := h.cache.store(hash, app.BinaryPath); err != nil {
+			h.logger.Warn("Failed to cache the build", zap.Error(err))
+		} else {
+			app.removeBuild()
+			app = h.cachedApp(binPath, hash)
+		}
+	}
+	return h.start(app)
+}
+
+// setBuild records the outcome of the build started at the given time.
+func (h *Harness) setBuild(started time.Time, failed bool, compileErrors []CompileError) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.compileErrors = compileErrors
+	h.lastBuild = buildInfo{Started: started, Duration: time.Since(started), Failed: failed}
+}
+
+func (h *Harness) cachedApp(binPath, hash string) *App {
+	app := NewApp(binPath, h.logger)
+	app.hash = hash
+	return app
+}
+
+// restart runs the current binary again, without rebuilding it.
+// If there is no successful build to restart, the app is rebuilt.
+func (h *Harness) restart() *egret.Error {
+	h.mu.Lock()
+	current, failed := h.app, h.lastBuild.Failed
+	h.mu.Unlock()
+	if current == nil || failed {
+		return h.refresh()
 	}
 
-	h.app.Port = h.port
-	if err2 := h.app.Cmd().Start(); err2 != nil {
-		return &egret.Error{
+	h.logger.Info("Restarting...")
+	app := h.cachedApp(current.BinaryPath, current.hash)
+	app.buildDir = current.buildDir
+	return h.start(app)
+}
+
+// start runs app next to the instance currently serving, and switches the
+// proxy over once it is up.
+func (h *Harness) start(app *App) *egret.Error {
+	// While a previous instance is serving, start the new one on another
+	// port and only switch the proxy over once it is ready.
+	h.mu.Lock()
+	old := h.app
+	reserved := h.reserved
+	h.reserved = nil
+	h.mu.Unlock()
+
+	app.Debug = h.Debug
+	if app.Debug != nil && old != nil {
+		// Only one instance can listen on the debugger's address.
+		h.mu.Lock()
+		h.app = nil
+		h.mu.Unlock()
+		old.Kill()
+		old = nil
+	}
+
+	port := h.port
+	if old != nil {
+		var err error
+		if port, reserved, err = reservePort(0); err != nil {
+			h.logger.Error("Failed to find a port for the new build", zap.Error(err))
+			return &egret.Error{
+				Name:    "failed_start_up",
+				Title:   "App failed to start up",
+				Summary: err.Error(),
+			}
+		}
+	}
+
+	app.Port = port
+	app.reserved = reserved
+	if err := app.Cmd().Start(); err != nil {
+		crashed := app.cmd.Crashed()
+		app.Kill()
+		failure := &egret.Error{
 			Name:    "failed_start_up",
 			Title:   "App failed to start up",
-			Summary: err2.Error(),
+			Summary: err.Error(),
+		}
+		if crashed {
+			failure = crashError(app.cmd)
+		}
+		if old == nil || old.BinaryPath != app.BinaryPath {
+			app.removeBuild()
 		}
+		if old != nil && !old.cmd.Crashed() {
+			// Keep serving the previous build, showing why the new one isn't.
+			h.logger.Error("New build failed to start up, still serving the previous one", zap.Error(err))
+			h.warn(startUpWarning, failure)
+			return nil
+		}
+		h.mu.Lock()
+		restarting := h.crashes > 0
+		h.mu.Unlock()
+		if restarting {
+			// Restarting after a crash, keep trying as the policy allows.
+			return h.crashed(failure, false, 0)
+		}
+		return failure
+	}
+
+	h.mu.Lock()
+	h.app = app
+	h.app.started = time.Now()
+	h.setTarget(port)
+	h.mu.Unlock()
+	h.warn(startUpWarning, nil)
+	h.warn(sanitizerWarning, nil)
+	if old != nil {
+		go func() {
+			old.Kill()
+			if old.BinaryPath != app.BinaryPath {
+				old.removeBuild()
+			}
+		}()
+	}
+	go h.monitor(app)
+
+	if h.reload != nil {
+		h.reload.Broadcast()
 	}
+	return nil
+}
 
-	return
+// monitor waits for the app to exit.  If it crashed while serving, the crash
+// is reported on the error page until the next rebuild.  The reports of the
+// race detector and sanitizers are shown as a warning, as the app keeps
+// serving.
+func (h *Harness) monitor(app *App) {
+	for {
+		select {
+		case <-app.cmd.sanitizer.notify:
+			h.mu.Lock()
+			current := h.app == app
+			h.mu.Unlock()
+			if current {
+				err := sanitizerError(app.cmd.SanitizerReports())
+				h.warn(sanitizerWarning, err)
+				h.logger.Warn("Sanitizer report", zap.String("error", err.Summary))
+			}
+		case <-app.cmd.waitChan():
+			if !app.cmd.Crashed() {
+				return
+			}
+			h.mu.Lock()
+			current := h.app == app
+			h.mu.Unlock()
+			if current {
+				success := app.cmd.ProcessState != nil && app.cmd.ProcessState.Success()
+				err := h.crashed(crashError(app.cmd), success, time.Since(app.started))
+				h.report(app, err, "App exited")
+			}
+			return
+		}
+	}
 }
 
-// WatchDir method returns false to file matches with doNotWatch
-// otheriwse true
+// warn shows err on the status page as the warning of the given source,
+// leaving the app serving, or clears that warning if err is nil.
+func (h *Harness) warn(source string, err *egret.Error) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if err == nil {
+		delete(h.warnings, source)
+	} else {
+		h.warnings[source] = err
+	}
+}
+
+// report shows err on the error page, if app is still the one serving.
+func (h *Harness) report(app *App, err *egret.Error, msg string) {
+	h.mu.Lock()
+	current := h.app == app
+	if current {
+		h.lastError = err
+		h.compileErrors = nil
+	}
+	h.mu.Unlock()
+	if !current {
+		return
+	}
+
+	h.logger.Error(msg, zap.String("error", err.Summary))
+	if h.reload != nil {
+		h.reload.Broadcast()
+	}
+}
+
+// proxyError handles requests the app failed to answer.  If the app crashed,
+// the crash is rendered instead of a bare 502.
+func (h *Harness) proxyError(w http.ResponseWriter, r *http.Request, err error) {
+	h.mu.Lock()
+	app := h.app
+	h.mu.Unlock()
+	if app != nil && app.cmd.Crashed() {
+		renderError(w, r, crashError(app.cmd))
+		return
+	}
+	h.logger.Error("Error proxying request", zap.String("url", r.URL.String()), zap.Error(err))
+	w.WriteHeader(http.StatusBadGateway)
+}
+
+// WatchDir method returns false to hidden directories and those matching
+// watch.exclude otherwise true
 func (h *Harness) WatchDir(info os.FileInfo) bool {
-	return !egret.ContainsString(doNotWatch, info.Name())
+	configMu.RLock()
+	defer configMu.RUnlock()
+	h.mu.Lock()
+	watch := h.watch
+	h.mu.Unlock()
+	return watch.watchDir(info.Name())
 }
 
-// WatchFile method returns true given filename HasSuffix of ".go"
-// otheriwse false
+// WatchFile method returns true if a change to filename requires an action,
+// which is recorded for the following Refresh.  Changes to the configuration
+// restart the app without rebuilding it.  Files written by the build hooks
+// or the asset pipeline are ignored, those the hooks watch trigger a rebuild,
+// and the sources of asset bundles have them rebuilt.
 func (h *Harness) WatchFile(filename string) bool {
-	return strings.HasSuffix(filename, ".go")
+	configMu.RLock()
+	defer configMu.RUnlock()
+	h.mu.Lock()
+	watch, hooks, assets := h.watch, h.hooks, h.assets
+	h.mu.Unlock()
+
+	if assets.isOutput(filename) {
+		return false
+	}
+	if hooks.wrote(filename) {
+		// The hooks may generate the sources of asset bundles.
+		if !assets.changed(filename) {
+			return false
+		}
+		return h.queueChange(actionReloadAssets)
+	}
+	action := watch.action(filename)
+	if hooks.changed(filename) {
+		action = actionRebuild
+	}
+	if action == actionRebuild && !isBuildInput(filepath.Base(filename)) {
+		// The build cache only knows about the Go sources.
+		atomic.StoreInt32(&h.forceBuild, 1)
+	}
+	if assets.changed(filename) && action < actionReloadAssets {
+		action = actionReloadAssets
+	}
+	if h.watchConf && isConfFile(filename) {
+		atomic.StoreInt32(&h.configChanged, 1)
+		if action < actionRestart {
+			action = actionRestart
+		}
+	}
+	if action == actionNone {
+		return false
+	}
+	return h.queueChange(action)
+}
+
+// queueChange raises the action to take on the next refresh to action, if it
+// is more expensive.  It reports that a refresh is needed.
+func (h *Harness) queueChange(action int32) bool {
+	for {
+		current := atomic.LoadInt32(&h.changeAction)
+		if action <= current || atomic.CompareAndSwapInt32(&h.changeAction, current, action) {
+			return true
+		}
+	}
 }
 
 // Run the harness, which listens for requests and proxies them to the app
@@ -166,61 +661,111 @@ func (h *Harness) Run() {
 		paths = append(paths, gopaths...)
 	}
 	paths = append(paths, egret.CodePaths...)
+	// Non-Go files anywhere in the app may be watched.
+	if !egret.ContainsString(paths, egret.BasePath) {
+		paths = append(paths, egret.BasePath)
+	}
+	// Fail before building if the port is taken.
+	if err := h.listen(); err != nil {
+		h.logger.Fatal("Cannot listen: " + err.Error() + "; stop it, or pick another port (-port auto for the next free one)")
+	}
+
 	watcher = egret.NewWatcher()
 	watcher.Listen(h, paths...)
 
-	go func() {
-		addr := fmt.Sprintf("%s:%d", egret.HttpAddr, egret.HttpPort)
-		h.logger.Info("Listening on address: " + addr)
+	watcher.Listen(&viewListener{h: h}, egret.CodePaths...)
 
-		var err error
-		if egret.HttpTLSEnabled {
-			err = http.ListenAndServeTLS(addr, egret.HttpTLSCert, egret.HttpTLSKey, h)
-		} else {
-			err = http.ListenAndServe(addr, h)
-		}
-		if err != nil {
-			h.logger.Fatal("Failed to start reverse proxy", zap.Error(err))
-		}
-	}()
+	// Changes are picked up and rebuilt in the background.
+	debounce, err := time.ParseDuration(egret.Config.GetStringDefault("harness.rebuild.debounce", "300ms"))
+	if err != nil {
+		h.logger.Fatal("Invalid harness.rebuild.debounce", zap.Error(err))
+	}
+	go h.rebuildLoop(debounce)
+	go h.notifyLoop()
 
 	// Kill the app on signal.
 	ch := make(chan os.Signal)
-	signal.Notify(ch, os.Interrupt, os.Kill)
+	signal.Notify(ch, os.Interrupt, os.Kill, syscall.SIGTERM)
 	<-ch
-	if h.app != nil {
-		h.app.Kill()
+	h.mu.Lock()
+	app := h.app
+	h.mu.Unlock()
+	if app != nil {
+		app.Kill()
 	}
 	os.Exit(1)
 }
 
-// Find an unused port
-func getFreePort(logger *zap.Logger) (port int) {
-	conn, err := net.Listen("tcp", ":0")
-	if err != nil {
-		logger.Fatal("Get free port error", zap.Error(err))
+// listen starts serving the proxy on the configured address, replacing the
+// listener started before, if any.
+func (h *Harness) listen() error {
+	addr := fmt.Sprintf("%s:%d", egret.HttpAddr, egret.HttpPort)
+
+	h.mu.Lock()
+	old := h.server
+	h.mu.Unlock()
+
+	// Load the certificate first, so that a bad one leaves the listener as
+	// it is.
+	tlsEnabled, cert, key := egret.HttpTLSEnabled, egret.HttpTLSCert, egret.HttpTLSKey
+	var tlsConfig *tls.Config
+	if tlsEnabled {
+		pair, err := tls.LoadX509KeyPair(cert, key)
+		if err != nil {
+			return fmt.Errorf("invalid TLS certificate or key: %s", err)
+		}
+		tlsConfig = &tls.Config{Certificates: []tls.Certificate{pair}}
 	}
 
-	port = conn.Addr().(*net.TCPAddr).Port
-	err = conn.Close()
+	// Listen before serving, so that a port conflict is reported right away.
+	ln, err := net.Listen("tcp", addr)
+	if err != nil && old != nil && old.Addr == addr {
+		// Only the TLS settings changed, hand the address over.
+		old.Close()
+		old = nil
+		ln, err = net.Listen("tcp", addr)
+	}
 	if err != nil {
-		logger.Fatal("Get free port error", zap.Error(err))
+		return portError(egret.HttpPort, err)
+	}
+	h.logger.Info("Listening on address: " + addr)
+
+	// HTTP/2 is negotiated over TLS, and accepted as h2c otherwise.
+	server := &http.Server{Addr: addr, Handler: h, TLSConfig: tlsConfig}
+	if !tlsEnabled {
+		server.Handler = h2c.NewHandler(h, &http2.Server{})
+	}
+
+	h.mu.Lock()
+	h.server = server
+	h.mu.Unlock()
+	if old != nil {
+		old.Close()
 	}
-	return port
+
+	go func() {
+		var err error
+		if tlsEnabled {
+			err = server.ServeTLS(ln, "", "")
+		} else {
+			err = server.Serve(ln)
+		}
+		if err != nil && err != http.ErrServerClosed {
+			h.logger.Fatal("Failed to start reverse proxy", zap.Error(err))
+		}
+	}()
+	return nil
 }
 
 // proxyWebsocket copies data between websocket client and server until one side
 // closes the connection.  (ReverseProxy doesn't work with websocket requests.)
-func proxyWebsocket(w http.ResponseWriter, r *http.Request, host string, logger *zap.Logger) {
+func proxyWebsocket(w http.ResponseWriter, r *http.Request, useTLS bool, host string, logger *zap.Logger) {
 	var (
 		d   net.Conn
 		err error
 	)
-	if egret.HttpTLSEnabled {
-		// since this proxy isn't used in production,
-		// it's OK to set InsecureSkipVerify to true
-		// no need to add another configuration option.
-		d, err = tls.Dial("tcp", host, &tls.Config{InsecureSkipVerify: true})
+	if useTLS {
+		d, err = tls.Dial("tcp", host, insecureTLSConfig())
 	} else {
 		d, err = net.Dial("tcp", host)
 	}
@@ -0,0 +1,329 @@
+package harness
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"sync"
+	"time"
+
+	"go.uber.org/zap"
+
+	"github.com/kenorld/egret-core"
+)
+
+const (
+	hookErrorName = "hook_error"
+	// maxHookOutput is how much of a failed hook's output is shown.
+	maxHookOutput = 16 * 1024
+)
+
+// hook is a command run before or after "go build".
+type hook struct {
+	command string
+	watch   []string // globs of the files the hook reads, relative to the app
+	outputs []string // globs of the files the hook writes, relative to the app
+	stale   bool     // a watched file changed since the hook last succeeded
+}
+
+// buildHooks are the commands run around "go build", as YAML lists or one
+// per line of:
+//
+//	build.hooks.pre   run before building, e.g. "go generate ./..."
+//	build.hooks.post  run after a successful build
+//
+// build.hooks.<run mode>.pre and .post, if set, replace them in that run mode.
+// The commands run in the app's base path, through sh (cmd on Windows), with
+// EGRET_IMPORT_PATH, EGRET_RUN_MODE and EGRET_BASE_PATH set.  A command may
+// start with the globs of the files it reads, and of those it writes after
+// "->", as in
+//
+//	[proto/*.proto, **/*.graphql] -> [gen/**] make generate
+//	-> [app/routes/*.go] go generate ./app/...
+//
+// Changes to the files read trigger a rebuild, and the command only runs
+// again when one of them changed.  Commands reading no files run on every
+// build.  Changes to the files written don't trigger a rebuild, unless their
+// content is no longer what the command left.  Neither do changes made to
+// any file while the pre-build hooks run, as long as its content is still
+// the one built.  Post-build hooks should list the files they write, as
+// writing others triggers a rebuild.  The asset bundles are built after the
+// pre-build hooks, and again when the hooks write their sources.
+type buildHooks struct {
+	mu        sync.Mutex
+	pre, post []*hook
+	running   bool              // hooks are running
+	written   map[string]string // hash of the files as the hooks left them, by path
+}
+
+func newBuildHooks() (*buildHooks, error) {
+	pre, err := parseHooks("pre")
+	if err != nil {
+		return nil, err
+	}
+	post, err := parseHooks("post")
+	if err != nil {
+		return nil, err
+	}
+	return &buildHooks{pre: pre, post: post, written: make(map[string]string)}, nil
+}
+
+// parseHooks reads the hooks of the given stage for the current run mode.
+func parseHooks(stage string) ([]*hook, error) {
+	key := "build.hooks." + egret.RunMode + "." + stage
+	lines, err := configLines(key)
+	if err != nil {
+		return nil, err
+	}
+	if len(lines) == 0 {
+		key = "build.hooks." + stage
+		if lines, err = configLines(key); err != nil {
+			return nil, err
+		}
+	}
+
+	var hooks []*hook
+	for _, line := range lines {
+		h := &hook{command: line, stale: true}
+		if strings.HasPrefix(h.command, "[") {
+			if h.watch, h.command, err = parseHookGlobs(key, h.command); err != nil {
+				return nil, err
+			}
+		}
+		if strings.HasPrefix(h.command, "->") {
+			h.command = strings.TrimSpace(strings.TrimPrefix(h.command, "->"))
+			if !strings.HasPrefix(h.command, "[") {
+				return nil, fmt.Errorf("%s: missing [outputs] after -> in %q", key, line)
+			}
+			if h.outputs, h.command, err = parseHookGlobs(key, h.command); err != nil {
+				return nil, err
+			}
+		}
+		if h.command == "" {
+			return nil, fmt.Errorf("%s: no command in %q", key, line)
+		}
+		hooks = append(hooks, h)
+	}
+	return hooks, nil
+}
+
+// parseHookGlobs splits s, starting with "[", into the globs between the
+// brackets and what follows them.
+func parseHookGlobs(key, s string) ([]string, string, error) {
+	end := strings.Index(s, "]")
+	if end < 0 {
+		return nil, "", fmt.Errorf("%s: missing ] in %q", key, s)
+	}
+	var globs []string
+	for _, glob := range strings.Split(s[1:end], ",") {
+		if glob = strings.TrimSpace(glob); glob != "" {
+			globs = append(globs, glob)
+		}
+	}
+	return globs, strings.TrimSpace(s[end+1:]), nil
+}
+
+// changed marks the hooks watching filename as stale, and reports whether
+// there was any.
+func (b *buildHooks) changed(filename string) bool {
+	name := relativeToApp(filename)
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	watched := false
+	for _, hooks := range [][]*hook{b.pre, b.post} {
+		for _, h := range hooks {
+			for _, glob := range h.watch {
+				if matchGlob(glob, name) {
+					h.stale, watched = true, true
+					break
+				}
+			}
+		}
+	}
+	return watched
+}
+
+// wrote reports whether the content of filename is as the hooks left it, or
+// whether it's one of their outputs and they are running, so that the files
+// they generate don't trigger another rebuild.
+func (b *buildHooks) wrote(filename string) bool {
+	name := relativeToApp(filename)
+	b.mu.Lock()
+	output := b.running && b.isOutput(name)
+	written, known := b.written[filename]
+	b.mu.Unlock()
+	if output || !known {
+		return output
+	}
+	if hash, err := hashFile(filename); err == nil && hash == written {
+		return true
+	}
+	// Changed since: forget it, so that restoring the content is a change too.
+	b.mu.Lock()
+	if b.written[filename] == written {
+		delete(b.written, filename)
+	}
+	b.mu.Unlock()
+	return false
+}
+
+// isOutput reports whether a hook writes the file of the given name,
+// relative to the app.
+func (b *buildHooks) isOutput(name string) bool {
+	for _, hooks := range [][]*hook{b.pre, b.post} {
+		for _, h := range hooks {
+			for _, glob := range h.outputs {
+				if matchGlob(glob, name) {
+					return true
+				}
+			}
+		}
+	}
+	return false
+}
+
+// record remembers the hash of the files the hooks that ran wrote, and, if
+// the pre-build hooks succeeded, of the files changed since they started, as
+// the build reads them next.
+func (b *buildHooks) record(stage string, ran []*hook, started time.Time, succeeded bool) {
+	var outputs []string
+	for _, h := range ran {
+		outputs = append(outputs, h.outputs...)
+	}
+	// Allow for file systems storing times with a precision of a second.
+	since := started.Truncate(time.Second)
+	written := make(map[string]string)
+	filepath.Walk(egret.BasePath, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return nil
+		}
+		if info.IsDir() {
+			if path != egret.BasePath && (isHiddenDir(info.Name()) || info.Name() == "node_modules") {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		name := relativeToApp(path)
+		matched := stage == "pre" && succeeded && !info.ModTime().Before(since)
+		for _, glob := range outputs {
+			matched = matched || matchGlob(glob, name)
+		}
+		if matched {
+			if hash, err := hashFile(path); err == nil {
+				written[path] = hash
+			}
+		}
+		return nil
+	})
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	for path, hash := range written {
+		b.written[path] = hash
+	}
+}
+
+// isHiddenDir reports whether the directory of the given name is skipped
+// when walking the app, as the go tool does.
+func isHiddenDir(name string) bool {
+	return strings.HasPrefix(name, ".") || strings.HasPrefix(name, "_")
+}
+
+// hashFile returns the SHA-256 hash of the content of a file.
+func hashFile(filename string) (string, error) {
+	data, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return "", err
+	}
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:]), nil
+}
+
+// run runs the hooks of the given stage, "pre" or "post", that have to.  Their
+// output is streamed to the console.  It returns an Error for the first one
+// failing.
+func (b *buildHooks) run(stage string, logger *zap.Logger) *egret.Error {
+	if b == nil {
+		return nil
+	}
+	b.mu.Lock()
+	hooks := b.pre
+	if stage == "post" {
+		hooks = b.post
+	}
+	var todo []*hook
+	for _, h := range hooks {
+		if h.stale || len(h.watch) == 0 {
+			todo = append(todo, h)
+		}
+	}
+	b.running = len(todo) > 0
+	b.mu.Unlock()
+	if len(todo) == 0 {
+		return nil
+	}
+	started := time.Now()
+	var err *egret.Error
+	for _, h := range todo {
+		if err = runHook(stage, h.command, logger); err != nil {
+			break
+		}
+		b.mu.Lock()
+		h.stale = false
+		b.mu.Unlock()
+	}
+
+	b.record(stage, todo, started, err == nil)
+	b.mu.Lock()
+	b.running = false
+	b.mu.Unlock()
+	return err
+}
+
+// runHook runs command through the shell, and returns an Error showing the
+// end of its output if it fails.
+func runHook(stage, command string, logger *zap.Logger) *egret.Error {
+	var cmd *exec.Cmd
+	if runtime.GOOS == "windows" {
+		cmd = exec.Command("cmd", "/C", command)
+	} else {
+		cmd = exec.Command("sh", "-c", command)
+	}
+	cmd.Dir = egret.BasePath
+	cmd.Env = append(os.Environ(),
+		"EGRET_IMPORT_PATH="+egret.ImportPath,
+		"EGRET_RUN_MODE="+egret.RunMode,
+		"EGRET_BASE_PATH="+egret.BasePath)
+	output := newTailBuffer(maxHookOutput)
+	stdout, stderr := newPrefixWriter(os.Stdout, stage+"-build"), newPrefixWriter(os.Stderr, stage+"-build")
+	cmd.Stdout, cmd.Stderr = io.MultiWriter(stdout, output), io.MultiWriter(stderr, output)
+
+	logger.Info("Running build hook", zap.String("stage", stage), zap.String("command", command))
+	started := time.Now()
+	err := cmd.Run()
+	stdout.Flush()
+	stderr.Flush()
+	if err == nil {
+		logger.Info("Build hook done", zap.String("command", command), zap.Duration("took", time.Since(started)))
+		return nil
+	}
+
+	logger.Error("Build hook failed", zap.String("command", command), zap.Error(err))
+	lines := strings.Split(strings.TrimRight(string(output.Bytes()), "\n"), "\n")
+	return &egret.Error{
+		Name:        hookErrorName,
+		Title:       "Build Hook Failed",
+		SourceType:  "build hook",
+		Path:        command,
+		Summary:     fmt.Sprintf("The %s-build hook %q failed: %s", stage, command, err),
+		SourceLines: lines,
+		Line:        len(lines),
+	}
+}
@@ -0,0 +1,524 @@
+package harness
+
+import (
+	"bytes"
+	"compress/flate"
+	"compress/gzip"
+	"compress/zlib"
+	"context"
+	"encoding/base64"
+	"fmt"
+	"html/template"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+	"unicode/utf8"
+
+	"github.com/kenorld/egret-core"
+)
+
+// exchange is a request proxied to the app, along with its response.
+type exchange struct {
+	ID       int64
+	Started  time.Time
+	Duration time.Duration
+
+	Method          string
+	URL             string
+	Proto           string
+	RequestHeader   http.Header
+	RequestBody     []byte
+	RequestBodySize int64 // -1 if unknown
+
+	Status           int
+	ResponseHeader   http.Header
+	ResponseBody     []byte
+	ResponseBodySize int64
+}
+
+// truncated reports whether the recorded request body is incomplete.
+func (e *exchange) truncated() bool {
+	return int64(len(e.RequestBody)) != e.RequestBodySize
+}
+
+// inspector records the most recent exchanges in a ring buffer.
+type inspector struct {
+	mu        sync.Mutex
+	entries   []*exchange
+	next      int // index of the next entry to overwrite
+	lastID    int64
+	bodyLimit int
+}
+
+func newInspector(size, bodyLimit int) *inspector {
+	return &inspector{
+		entries:   make([]*exchange, 0, size),
+		bodyLimit: bodyLimit,
+	}
+}
+
+// record starts recording the exchange of r.  It returns the writer and
+// request to serve it with, and a function to call once it has been served.
+func (in *inspector) record(w http.ResponseWriter, r *http.Request) (http.ResponseWriter, *http.Request, func()) {
+	scheme := "http"
+	if r.TLS != nil {
+		scheme = "https"
+	}
+	e := &exchange{
+		Started:         time.Now(),
+		Method:          r.Method,
+		URL:             scheme + "://" + r.Host + r.URL.RequestURI(),
+		Proto:           r.Proto,
+		RequestHeader:   r.Header.Clone(),
+		RequestBodySize: r.ContentLength,
+	}
+
+	var tee *teeReadCloser
+	if r.Body != nil && r.Body != http.NoBody {
+		tee = &teeReadCloser{ReadCloser: r.Body, buf: limitedBuffer{limit: in.bodyLimit}}
+		r.Body = tee
+	}
+	rw := &recordingWriter{ResponseWriter: w, body: limitedBuffer{limit: in.bodyLimit}}
+
+	return rw, r, func() {
+		e.Duration = time.Since(e.Started)
+		var written int64
+		if tee != nil {
+			e.RequestBody, written = tee.snapshot()
+		}
+		if e.RequestBodySize < 0 || written > e.RequestBodySize {
+			e.RequestBodySize = written
+		}
+		e.Status = rw.status
+		if e.Status == 0 {
+			e.Status = http.StatusOK
+		}
+		e.ResponseHeader = rw.Header().Clone()
+		e.ResponseBody = rw.body.Bytes()
+		e.ResponseBodySize = rw.body.written
+		in.add(e)
+	}
+}
+
+func (in *inspector) add(e *exchange) {
+	in.mu.Lock()
+	defer in.mu.Unlock()
+	in.lastID++
+	e.ID = in.lastID
+	if len(in.entries) < cap(in.entries) {
+		in.entries = append(in.entries, e)
+		return
+	}
+	in.entries[in.next] = e
+	in.next = (in.next + 1) % len(in.entries)
+}
+
+// list returns the recorded exchanges, oldest first.
+func (in *inspector) list() []*exchange {
+	in.mu.Lock()
+	defer in.mu.Unlock()
+	list := make([]*exchange, 0, len(in.entries))
+	list = append(list, in.entries[in.next:]...)
+	return append(list, in.entries[:in.next]...)
+}
+
+func (in *inspector) get(id int64) *exchange {
+	for _, e := range in.list() {
+		if e.ID == id {
+			return e
+		}
+	}
+	return nil
+}
+
+// ResponseText returns the response body to show, decoded if possible.
+func (e *exchange) ResponseText() []byte {
+	content, _ := e.responseContent()
+	return content
+}
+
+// limitedBuffer keeps the first limit bytes written to it, and counts the rest.
+type limitedBuffer struct {
+	bytes.Buffer
+	limit   int
+	written int64
+}
+
+func (b *limitedBuffer) Write(p []byte) (int, error) {
+	b.written += int64(len(p))
+	if room := b.limit - b.Len(); room > 0 {
+		if len(p) > room {
+			b.Buffer.Write(p[:room])
+		} else {
+			b.Buffer.Write(p)
+		}
+	}
+	return len(p), nil
+}
+
+// teeReadCloser copies what is read from a request body to a buffer.  The
+// transport may still be reading the body once the response is done, so the
+// buffer is guarded.
+type teeReadCloser struct {
+	io.ReadCloser
+	mu  sync.Mutex
+	buf limitedBuffer
+}
+
+func (t *teeReadCloser) Read(p []byte) (int, error) {
+	n, err := t.ReadCloser.Read(p)
+	t.mu.Lock()
+	t.buf.Write(p[:n])
+	t.mu.Unlock()
+	return n, err
+}
+
+// snapshot returns a copy of what was read so far, and how much it was.
+func (t *teeReadCloser) snapshot() ([]byte, int64) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return append([]byte(nil), t.buf.Bytes()...), t.buf.written
+}
+
+// recordingWriter records the status and body written to a ResponseWriter.
+type recordingWriter struct {
+	http.ResponseWriter
+	status int
+	body   limitedBuffer
+}
+
+func (rw *recordingWriter) WriteHeader(status int) {
+	if rw.status == 0 {
+		rw.status = status
+	}
+	rw.ResponseWriter.WriteHeader(status)
+}
+
+func (rw *recordingWriter) Write(p []byte) (int, error) {
+	if rw.status == 0 {
+		rw.status = http.StatusOK
+	}
+	rw.body.Write(p)
+	return rw.ResponseWriter.Write(p)
+}
+
+func (rw *recordingWriter) Flush() {
+	if f, ok := rw.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+// Unwrap lets http.ResponseController reach the underlying writer.
+func (rw *recordingWriter) Unwrap() http.ResponseWriter {
+	return rw.ResponseWriter
+}
+
+// discardWriter is the ResponseWriter of replayed requests.
+type discardWriter struct {
+	header http.Header
+}
+
+func (d *discardWriter) Header() http.Header         { return d.header }
+func (d *discardWriter) Write(p []byte) (int, error) { return len(p), nil }
+func (d *discardWriter) WriteHeader(int)             {}
+
+// replayTimeout is how long a replayed request may take, so that replaying a
+// streaming exchange doesn't run forever.
+const replayTimeout = 30 * time.Second
+
+// replay sends a recorded request through the harness again, against the
+// current build, in the background.  The new exchange is recorded as any
+// other.
+func (h *Harness) replay(e *exchange) error {
+	u, err := url.Parse(e.URL)
+	if err != nil {
+		return err
+	}
+	r, err := http.NewRequest(e.Method, e.URL, bytes.NewReader(e.RequestBody))
+	if err != nil {
+		return err
+	}
+	r.Header = e.RequestHeader.Clone()
+	r.Host = u.Host
+	r.RequestURI = u.RequestURI()
+	r.RemoteAddr = "127.0.0.1:0"
+	ctx, cancel := context.WithTimeout(context.Background(), replayTimeout)
+	go func() {
+		defer cancel()
+		h.ServeHTTP(&discardWriter{header: http.Header{}}, r.WithContext(ctx))
+	}()
+	return nil
+}
+
+func (h *Harness) serveRequests(w http.ResponseWriter, r *http.Request) {
+	list := h.inspector.list()
+	for i, j := 0, len(list)-1; i < j; i, j = i+1, j-1 {
+		list[i], list[j] = list[j], list[i]
+	}
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	requestsTemplate.Execute(w, struct {
+		AppName  string
+		Requests []*exchange
+	}{appName(), list})
+}
+
+func (h *Harness) serveReplay(w http.ResponseWriter, r *http.Request) {
+	if !checkPost(w, r) {
+		return
+	}
+	id, _ := strconv.ParseInt(r.FormValue("id"), 10, 64)
+	e := h.inspector.get(id)
+	if e == nil {
+		http.NotFound(w, r)
+		return
+	}
+	if e.truncated() {
+		http.Error(w, "The request body was truncated and can't be replayed.", http.StatusConflict)
+		return
+	}
+	if err := h.replay(e); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	http.Redirect(w, r, adminPath+"/requests", http.StatusSeeOther)
+}
+
+// HAR 1.2, see http://www.softwareishard.com/blog/har-12-spec/
+type harLog struct {
+	Log struct {
+		Version string     `json:"version"`
+		Creator harCreator `json:"creator"`
+		Entries []harEntry `json:"entries"`
+	} `json:"log"`
+}
+
+type harCreator struct {
+	Name    string `json:"name"`
+	Version string `json:"version"`
+}
+
+type harEntry struct {
+	StartedDateTime string      `json:"startedDateTime"`
+	Time            float64     `json:"time"`
+	Request         harRequest  `json:"request"`
+	Response        harResponse `json:"response"`
+	Cache           struct{}    `json:"cache"`
+	Timings         harTimings  `json:"timings"`
+}
+
+type harRequest struct {
+	Method      string         `json:"method"`
+	URL         string         `json:"url"`
+	HTTPVersion string         `json:"httpVersion"`
+	Cookies     []harNameValue `json:"cookies"`
+	Headers     []harNameValue `json:"headers"`
+	QueryString []harNameValue `json:"queryString"`
+	PostData    *harPostData   `json:"postData,omitempty"`
+	HeadersSize int            `json:"headersSize"`
+	BodySize    int64          `json:"bodySize"`
+}
+
+type harResponse struct {
+	Status      int            `json:"status"`
+	StatusText  string         `json:"statusText"`
+	HTTPVersion string         `json:"httpVersion"`
+	Cookies     []harNameValue `json:"cookies"`
+	Headers     []harNameValue `json:"headers"`
+	Content     harContent     `json:"content"`
+	RedirectURL string         `json:"redirectURL"`
+	HeadersSize int            `json:"headersSize"`
+	BodySize    int64          `json:"bodySize"`
+}
+
+type harNameValue struct {
+	Name  string `json:"name"`
+	Value string `json:"value"`
+}
+
+type harPostData struct {
+	MimeType string `json:"mimeType"`
+	Text     string `json:"text"`
+}
+
+type harContent struct {
+	Size        int64  `json:"size"`
+	Compression int64  `json:"compression,omitempty"`
+	MimeType    string `json:"mimeType"`
+	Text        string `json:"text,omitempty"`
+	Encoding    string `json:"encoding,omitempty"`
+	Comment     string `json:"comment,omitempty"`
+}
+
+type harTimings struct {
+	Send    float64 `json:"send"`
+	Wait    float64 `json:"wait"`
+	Receive float64 `json:"receive"`
+}
+
+func harHeaders(header http.Header) []harNameValue {
+	list := []harNameValue{}
+	for name, values := range header {
+		for _, v := range values {
+			list = append(list, harNameValue{name, v})
+		}
+	}
+	return list
+}
+
+func (e *exchange) har() harEntry {
+	ms := float64(e.Duration) / float64(time.Millisecond)
+	entry := harEntry{
+		StartedDateTime: e.Started.Format(time.RFC3339Nano),
+		Time:            ms,
+		Timings:         harTimings{Wait: ms},
+		Request: harRequest{
+			Method:      e.Method,
+			URL:         e.URL,
+			HTTPVersion: e.Proto,
+			Cookies:     []harNameValue{},
+			Headers:     harHeaders(e.RequestHeader),
+			QueryString: []harNameValue{},
+			HeadersSize: -1,
+			BodySize:    e.RequestBodySize,
+		},
+		Response: harResponse{
+			Status:      e.Status,
+			StatusText:  http.StatusText(e.Status),
+			HTTPVersion: e.Proto,
+			Cookies:     []harNameValue{},
+			Headers:     harHeaders(e.ResponseHeader),
+			Content: harContent{
+				Size:     e.ResponseBodySize,
+				MimeType: e.ResponseHeader.Get("Content-Type"),
+			},
+			RedirectURL: e.ResponseHeader.Get("Location"),
+			HeadersSize: -1,
+			BodySize:    e.ResponseBodySize,
+		},
+	}
+
+	if u, err := url.Parse(e.URL); err == nil {
+		for name, values := range u.Query() {
+			for _, v := range values {
+				entry.Request.QueryString = append(entry.Request.QueryString, harNameValue{name, v})
+			}
+		}
+	}
+	if len(e.RequestBody) > 0 {
+		entry.Request.PostData = &harPostData{
+			MimeType: e.RequestHeader.Get("Content-Type"),
+			Text:     string(e.RequestBody),
+		}
+	}
+	// HAR content is the decoded body.
+	content, err := e.responseContent()
+	if err != nil {
+		entry.Response.Content.Comment = "Not decoded: " + err.Error()
+	} else if encoding := e.ResponseHeader.Get("Content-Encoding"); encoding != "" && !strings.EqualFold(encoding, "identity") {
+		entry.Response.Content.Size = int64(len(content))
+		if int64(len(e.ResponseBody)) == e.ResponseBodySize {
+			entry.Response.Content.Compression = entry.Response.Content.Size - e.ResponseBodySize
+		}
+	}
+	if utf8.Valid(content) {
+		entry.Response.Content.Text = string(content)
+	} else {
+		entry.Response.Content.Text = base64.StdEncoding.EncodeToString(content)
+		entry.Response.Content.Encoding = "base64"
+	}
+	return entry
+}
+
+// responseContent returns the recorded response body, decoded according to
+// its Content-Encoding.  The body is returned as is, with an error, if the
+// encoding isn't supported.  A truncated body is decoded as far as it goes.
+func (e *exchange) responseContent() ([]byte, error) {
+	body := e.ResponseBody
+	var r io.Reader
+	switch encoding := strings.ToLower(strings.TrimSpace(e.ResponseHeader.Get("Content-Encoding"))); encoding {
+	case "", "identity":
+		return body, nil
+	case "gzip", "x-gzip":
+		zr, err := gzip.NewReader(bytes.NewReader(body))
+		if err != nil {
+			return body, err
+		}
+		r = zr
+	case "deflate":
+		// Usually zlib wrapped, sometimes raw.
+		if zr, err := zlib.NewReader(bytes.NewReader(body)); err == nil {
+			r = zr
+		} else {
+			r = flate.NewReader(bytes.NewReader(body))
+		}
+	default:
+		return body, fmt.Errorf("unsupported Content-Encoding %q", encoding)
+	}
+	content, err := ioutil.ReadAll(r)
+	if err != nil && len(content) == 0 {
+		return body, err
+	}
+	return content, nil
+}
+
+func (h *Harness) serveHAR(w http.ResponseWriter, r *http.Request) {
+	var log harLog
+	log.Log.Version = "1.2"
+	log.Log.Creator = harCreator{Name: "egret harness", Version: egret.Version}
+	log.Log.Entries = []harEntry{}
+	for _, e := range h.inspector.list() {
+		log.Log.Entries = append(log.Log.Entries, e.har())
+	}
+	w.Header().Set("Content-Disposition", `attachment; filename="requests.har"`)
+	writeJSON(w, http.StatusOK, log)
+}
+
+var requestsTemplate = template.Must(template.New("requests").Funcs(template.FuncMap{
+	"text": func(b []byte) string { return string(b) },
+	"ms":   func(d time.Duration) int64 { return int64(d / time.Millisecond) },
+}).Parse(`<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<title>{{.AppName}} - Requests</title>
+<style>
+body { font-family: sans-serif; margin: 0; color: #333; }
+header { background: #2a6ebb; color: #fff; padding: 12px 16px; }
+header h1 { display: inline; font-size: 20px; margin: 0; }
+header a { color: #fff; margin-left: 12px; }
+details { border-bottom: 1px solid #ddd; padding: 6px 16px; }
+summary { font-family: monospace; cursor: pointer; }
+.status { display: inline-block; width: 3em; }
+.error { color: #c33; }
+pre { background: #f6f6f6; max-height: 300px; overflow: auto; padding: 8px; white-space: pre-wrap; }
+</style>
+</head>
+<body>
+<header>
+<h1>Requests</h1>
+<a href="/@harness/">Dashboard</a>
+<a href="/@harness/requests.har">Export HAR</a>
+</header>
+{{range .Requests}}<details>
+<summary><span class="status{{if ge .Status 400}} error{{end}}">{{.Status}}</span> {{.Method}} {{.URL}} ({{ms .Duration}} ms)</summary>
+<form method="POST" action="/@harness/requests/replay"><input type="hidden" name="id" value="{{.ID}}"><button>Replay</button></form>
+<h4>Request</h4>
+<pre>{{.Method}} {{.URL}} {{.Proto}}
+{{range $name, $values := .RequestHeader}}{{range $values}}{{$name}}: {{.}}
+{{end}}{{end}}
+{{text .RequestBody}}</pre>
+<h4>Response</h4>
+<pre>{{.Status}}
+{{range $name, $values := .ResponseHeader}}{{range $values}}{{$name}}: {{.}}
+{{end}}{{end}}
+{{text .ResponseText}}</pre>
+</details>
+{{else}}<p style="padding: 0 16px">No requests yet.</p>
+{{end}}</body>
+</html>
+`))
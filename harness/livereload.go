@@ -0,0 +1,122 @@
+package harness
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+
+	"go.uber.org/zap"
+)
+
+// liveReloadPath is the reserved route serving the live-reload event stream.
+const liveReloadPath = "/@harness/livereload"
+
+// liveReloadScript is injected into proxied HTML pages. It reloads the page
+// whenever the harness pushes a "reload" event.
+const liveReloadScript = `<script>
+(function() {
+	if (!window.EventSource) { return; }
+	var es = new EventSource("` + liveReloadPath + `");
+	es.addEventListener("reload", function() { es.close(); window.location.reload(); });
+})();
+</script>
+`
+
+// liveReload keeps track of the browsers connected to the live-reload
+// event stream and notifies them when the app should be reloaded.
+type liveReload struct {
+	mu      sync.Mutex
+	clients map[chan struct{}]struct{}
+	logger  *zap.Logger
+}
+
+func newLiveReload(logger *zap.Logger) *liveReload {
+	return &liveReload{
+		clients: make(map[chan struct{}]struct{}),
+		logger:  logger,
+	}
+}
+
+// ServeHTTP streams reload events to a browser as Server-Sent Events.
+func (lr *liveReload) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		http.Error(w, "Streaming unsupported", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("Connection", "keep-alive")
+	w.WriteHeader(http.StatusOK)
+	flusher.Flush()
+
+	ch := make(chan struct{}, 1)
+	lr.mu.Lock()
+	lr.clients[ch] = struct{}{}
+	lr.mu.Unlock()
+
+	defer func() {
+		lr.mu.Lock()
+		delete(lr.clients, ch)
+		lr.mu.Unlock()
+	}()
+
+	for {
+		select {
+		case <-r.Context().Done():
+			return
+		case <-ch:
+			fmt.Fprint(w, "event: reload\ndata: {}\n\n")
+			flusher.Flush()
+		}
+	}
+}
+
+// Broadcast tells every connected browser to reload.
+func (lr *liveReload) Broadcast() {
+	lr.mu.Lock()
+	defer lr.mu.Unlock()
+	if len(lr.clients) == 0 {
+		return
+	}
+	lr.logger.Info("Live reload", zap.Int("clients", len(lr.clients)))
+	for ch := range lr.clients {
+		select {
+		case ch <- struct{}{}:
+		default:
+		}
+	}
+}
+
+// injectScript inserts the live-reload client script into an uncompressed
+// HTML response, right before the closing body tag if there is one.
+func injectScript(resp *http.Response) error {
+	if !strings.HasPrefix(resp.Header.Get("Content-Type"), "text/html") {
+		return nil
+	}
+	if enc := resp.Header.Get("Content-Encoding"); enc != "" && enc != "identity" {
+		return nil
+	}
+
+	body, err := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	if err != nil {
+		return err
+	}
+
+	if i := bytes.LastIndex(bytes.ToLower(body), []byte("</body>")); i >= 0 {
+		body = append(body[:i], append([]byte(liveReloadScript), body[i:]...)...)
+	} else {
+		body = append(body, liveReloadScript...)
+	}
+
+	resp.Body = ioutil.NopCloser(bytes.NewReader(body))
+	resp.ContentLength = int64(len(body))
+	resp.Header.Set("Content-Length", strconv.Itoa(len(body)))
+	return nil
+}
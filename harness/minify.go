@@ -0,0 +1,30 @@
+package harness
+
+import (
+	"github.com/tdewolff/minify/v2"
+	"github.com/tdewolff/minify/v2/css"
+	"github.com/tdewolff/minify/v2/js"
+)
+
+// minifier minifies stylesheets and scripts.  Both are fully parsed, so
+// anything it can't make sense of is reported rather than mangled, and
+// "/*!" license comments are kept.
+var minifier = newMinifier()
+
+func newMinifier() *minify.M {
+	m := minify.New()
+	m.AddFunc("text/css", css.Minify)
+	m.Add("application/javascript", &js.Minifier{KeepVarNames: true})
+	return m
+}
+
+// minifyCSS minifies a stylesheet.
+func minifyCSS(src string) (string, error) {
+	return minifier.String("text/css", src)
+}
+
+// minifyJS minifies a script.  Variable names are left as they are, so that
+// the bundles stay readable in the browser's debugger.
+func minifyJS(src string) (string, error) {
+	return minifier.String("application/javascript", src)
+}
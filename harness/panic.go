@@ -0,0 +1,142 @@
+package harness
+
+import (
+	"bytes"
+	"fmt"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/kenorld/egret-core"
+)
+
+// frameLocationPattern matches the location line of a stack frame,
+// e.g. "	/go/src/app/routes/app.go:42 +0x1d".
+var frameLocationPattern = regexp.MustCompile(`^\t(.+\.go):(\d+)(?: \+0x[0-9a-f]+)?$`)
+
+// StackFrame is a single frame of a goroutine trace.
+type StackFrame struct {
+	Func string
+	File string
+	Line int
+}
+
+// Panic is a Go panic parsed from the app's stderr.
+type Panic struct {
+	Message string
+	Frames  []StackFrame // frames of the panicking goroutine
+}
+
+// parsePanic finds the last panic (or fatal error) in output and parses the
+// trace of the goroutine that caused it.  It returns nil if there is none.
+func parsePanic(output []byte) *Panic {
+	start := -1
+	for _, marker := range []string{"panic: ", "fatal error: "} {
+		if bytes.HasPrefix(output, []byte(marker)) {
+			start = 0
+		}
+		if i := bytes.LastIndex(output, []byte("\n"+marker)); i >= 0 && i+1 > start {
+			start = i + 1
+		}
+	}
+	if start < 0 {
+		return nil
+	}
+
+	lines := strings.Split(string(output[start:]), "\n")
+	p := &Panic{}
+
+	// The message runs up to the first goroutine header.
+	i := 0
+	var msg []string
+	for ; i < len(lines) && !strings.HasPrefix(lines[i], "goroutine "); i++ {
+		if line := strings.TrimSpace(lines[i]); line != "" {
+			msg = append(msg, line)
+		}
+	}
+	p.Message = strings.Join(msg, "\n")
+
+	// Frames are pairs of function and location lines, up to a blank line.
+	for i++; i+1 < len(lines) && lines[i] != ""; i += 2 {
+		m := frameLocationPattern.FindStringSubmatch(lines[i+1])
+		if m == nil {
+			break
+		}
+		line, _ := strconv.Atoi(m[2])
+		p.Frames = append(p.Frames, StackFrame{Func: lines[i], File: m[1], Line: line})
+	}
+	return p
+}
+
+// appFrames returns the frames located in the app's source code.
+func appFrames(all []StackFrame) []StackFrame {
+	basePath, _ := filepath.Abs(egret.BasePath)
+	var frames []StackFrame
+	for _, f := range all {
+		if strings.HasPrefix(filepath.Clean(f.File), basePath+string(filepath.Separator)) {
+			frames = append(frames, f)
+		}
+	}
+	return frames
+}
+
+// toError returns an Error rendering the panic, pointing at the innermost
+// frame in the app's source.
+func (p *Panic) toError() *egret.Error {
+	err := &egret.Error{
+		SourceType: "Go code",
+		Name:       "runtime_panic",
+		Title:      "App Panic",
+		Summary:    p.Message,
+	}
+	pointAt(err, appFrames(p.Frames))
+	return err
+}
+
+// pointAt adds the trace of the app frames to the summary of err, and points
+// it at the innermost one.
+func pointAt(err *egret.Error, frames []StackFrame) {
+	if len(frames) == 0 {
+		return
+	}
+
+	var trace []string
+	for _, f := range frames {
+		trace = append(trace, fmt.Sprintf("%s (%s:%d)", f.Func, f.File, f.Line))
+	}
+	err.Summary += " at " + strings.Join(trace, " <- ")
+
+	top := frames[0]
+	err.Path, err.Line = top.File, top.Line
+	if rel, relErr := filepath.Rel(egret.BasePath, top.File); relErr == nil {
+		err.Path = rel
+	}
+	lines, readErr := egret.ReadLines(top.File)
+	if readErr != nil {
+		err.MetaError = top.File + ": " + readErr.Error()
+		return
+	}
+	err.SourceLines = lines
+}
+
+// crashError describes why the app exited on its own.
+func crashError(cmd AppCmd) *egret.Error {
+	configMu.RLock()
+	defer configMu.RUnlock()
+	if p := cmd.Panic(); p != nil {
+		return p.toError()
+	}
+	if reports := cmd.SanitizerReports(); len(reports) > 0 {
+		return sanitizerError(reports)
+	}
+	summary := "The app exited unexpectedly."
+	if cmd.ProcessState != nil {
+		summary = "The app exited unexpectedly: " + cmd.ProcessState.String()
+	}
+	return &egret.Error{
+		Name:    "app_died",
+		Title:   "App died",
+		Summary: summary,
+	}
+}
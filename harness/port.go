@@ -0,0 +1,69 @@
+package harness
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+	"syscall"
+)
+
+// maxPortSearch is how many ports NextFreePort tries.
+const maxPortSearch = 100
+
+// CheckPort method returns an error naming the process listening on port, if
+// addr:port can't be listened on.
+func CheckPort(addr string, port int) error {
+	ln, err := net.Listen("tcp", net.JoinHostPort(addr, strconv.Itoa(port)))
+	if err != nil {
+		return portError(port, err)
+	}
+	return ln.Close()
+}
+
+// NextFreePort method returns the first port from port on that addr can be
+// listened on.
+func NextFreePort(addr string, port int) (int, error) {
+	for p := port; p < port+maxPortSearch && p <= 65535; p++ {
+		if ln, err := net.Listen("tcp", net.JoinHostPort(addr, strconv.Itoa(p))); err == nil {
+			ln.Close()
+			return p, nil
+		}
+	}
+	return 0, fmt.Errorf("no free port between %d and %d", port, port+maxPortSearch-1)
+}
+
+// reservePort listens on port, or on a free port if zero, and returns the
+// port with the listener holding it.  Closing the listener right before the
+// app binds the port keeps other processes from taking it in between.
+func reservePort(port int) (int, net.Listener, error) {
+	ln, err := net.Listen("tcp", fmt.Sprintf(":%d", port))
+	if err != nil {
+		return 0, nil, portError(port, err)
+	}
+	return ln.Addr().(*net.TCPAddr).Port, ln, nil
+}
+
+// portError turns a failure to listen on port into an error naming the
+// process holding it, where it can be found.
+func portError(port int, err error) error {
+	if !isAddrInUse(err) {
+		return err
+	}
+	msg := fmt.Sprintf("port %d is already in use", port)
+	if owner := portOwner(port); owner != "" {
+		msg += " by " + owner
+	}
+	return errors.New(msg)
+}
+
+func isAddrInUse(err error) bool {
+	if errors.Is(err, syscall.EADDRINUSE) {
+		return true
+	}
+	// Windows reports WSAEADDRINUSE, which isn't syscall.EADDRINUSE.
+	msg := err.Error()
+	return strings.Contains(msg, "address already in use") ||
+		strings.Contains(msg, "Only one usage of each socket address")
+}
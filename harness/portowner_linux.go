@@ -0,0 +1,65 @@
+package harness
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// tcpListen is the state of listening sockets in /proc/net/tcp.
+const tcpListen = "0A"
+
+// portOwner returns the process listening on port, e.g. "nginx (pid 1234)",
+// or an empty string if it can't be found.  The socket is looked up in
+// /proc/net/tcp{,6}, and its inode among the open files of each process the
+// user can see.
+func portOwner(port int) string {
+	inodes := make(map[string]bool)
+	for _, table := range []string{"/proc/net/tcp", "/proc/net/tcp6"} {
+		data, err := ioutil.ReadFile(table)
+		if err != nil {
+			continue
+		}
+		for _, line := range strings.Split(string(data), "\n")[1:] {
+			// sl local_address rem_address st tx_queue:rx_queue tr:tm->when retrnsmt uid timeout inode
+			fields := strings.Fields(line)
+			if len(fields) < 10 || fields[3] != tcpListen {
+				continue
+			}
+			i := strings.LastIndexByte(fields[1], ':')
+			if p, err := strconv.ParseInt(fields[1][i+1:], 16, 32); err == nil && int(p) == port {
+				inodes["socket:["+fields[9]+"]"] = true
+			}
+		}
+	}
+	if len(inodes) == 0 {
+		return ""
+	}
+
+	procs, err := ioutil.ReadDir("/proc")
+	if err != nil {
+		return ""
+	}
+	for _, proc := range procs {
+		pid, err := strconv.Atoi(proc.Name())
+		if err != nil {
+			continue
+		}
+		fds, err := ioutil.ReadDir(filepath.Join("/proc", proc.Name(), "fd"))
+		if err != nil {
+			continue
+		}
+		for _, fd := range fds {
+			link, err := os.Readlink(filepath.Join("/proc", proc.Name(), "fd", fd.Name()))
+			if err != nil || !inodes[link] {
+				continue
+			}
+			comm, _ := ioutil.ReadFile(filepath.Join("/proc", proc.Name(), "comm"))
+			return fmt.Sprintf("%s (pid %d)", strings.TrimSpace(string(comm)), pid)
+		}
+	}
+	return "another user's process"
+}
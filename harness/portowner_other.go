@@ -0,0 +1,36 @@
+//go:build !linux && !windows
+// +build !linux,!windows
+
+package harness
+
+import (
+	"fmt"
+	"os/exec"
+	"strings"
+)
+
+// portOwner returns the process listening on port, e.g. "nginx (pid 1234)",
+// or an empty string if it can't be found.  It asks lsof, where installed.
+func portOwner(port int) string {
+	out, err := exec.Command("lsof", "-nP", fmt.Sprintf("-iTCP:%d", port), "-sTCP:LISTEN", "-Fpc").Output()
+	if err != nil {
+		return ""
+	}
+	// One field per line: p<pid>, then c<command>.
+	var pid, command string
+	for _, line := range strings.Split(string(out), "\n") {
+		if len(line) < 2 {
+			continue
+		}
+		switch line[0] {
+		case 'p':
+			pid = line[1:]
+		case 'c':
+			command = line[1:]
+		}
+		if pid != "" && command != "" {
+			return fmt.Sprintf("%s (pid %s)", command, pid)
+		}
+	}
+	return ""
+}
@@ -0,0 +1,43 @@
+package harness
+
+import (
+	"encoding/csv"
+	"fmt"
+	"os/exec"
+	"strconv"
+	"strings"
+)
+
+// portOwner returns the process listening on port, e.g. "nginx.exe (pid 1234)",
+// or an empty string if it can't be found.  The pid is read from netstat, and
+// its image name from tasklist.
+func portOwner(port int) string {
+	out, err := exec.Command("netstat", "-ano", "-p", "TCP").Output()
+	if err != nil {
+		return ""
+	}
+	suffix := ":" + strconv.Itoa(port)
+	pid := ""
+	for _, line := range strings.Split(string(out), "\n") {
+		// Proto  Local Address  Foreign Address  State  PID
+		fields := strings.Fields(line)
+		if len(fields) == 5 && fields[3] == "LISTENING" && strings.HasSuffix(fields[1], suffix) {
+			pid = fields[4]
+			break
+		}
+	}
+	if pid == "" {
+		return ""
+	}
+
+	out, err = exec.Command("tasklist", "/FI", "PID eq "+pid, "/FO", "CSV", "/NH").Output()
+	if err != nil {
+		return "pid " + pid
+	}
+	// "nginx.exe","1234","Console","1","10,240 K"
+	record, err := csv.NewReader(strings.NewReader(string(out))).Read()
+	if err != nil || len(record) < 2 || record[1] != pid {
+		return "pid " + pid
+	}
+	return fmt.Sprintf("%s (pid %s)", record[0], pid)
+}
@@ -0,0 +1,45 @@
+//go:build !windows
+// +build !windows
+
+package harness
+
+import (
+	"os"
+	"os/exec"
+	"syscall"
+)
+
+// setProcessGroup starts the command in its own process group, so that the
+// app and any subprocesses it spawns can be signalled together.
+func setProcessGroup(cmd *exec.Cmd) {
+	cmd.SysProcAttr = &syscall.SysProcAttr{Setpgid: true}
+}
+
+// terminateProcess asks the process group to shut down gracefully.
+func terminateProcess(p *os.Process) error {
+	return signalGroup(p, syscall.SIGTERM)
+}
+
+// interruptProcess interrupts the process group, as Ctrl+C would.
+func interruptProcess(p *os.Process) error {
+	return signalGroup(p, syscall.SIGINT)
+}
+
+// killProcessGroup kills every process left in the process group.
+func killProcessGroup(p *os.Process) error {
+	return signalGroup(p, syscall.SIGKILL)
+}
+
+func signalGroup(p *os.Process, sig syscall.Signal) error {
+	err := syscall.Kill(-p.Pid, sig)
+	if err == syscall.ESRCH {
+		// The group is already gone.
+		return nil
+	}
+	return err
+}
+
+// reloadSignal asks the app to reload its templates.
+func reloadSignal(p *os.Process) error {
+	return p.Signal(syscall.SIGHUP)
+}
@@ -0,0 +1,43 @@
+package harness
+
+import (
+	"errors"
+	"os"
+	"os/exec"
+	"strconv"
+	"syscall"
+)
+
+// setProcessGroup starts the command in its own process group, so that the
+// app and any subprocesses it spawns can be stopped together.
+func setProcessGroup(cmd *exec.Cmd) {
+	cmd.SysProcAttr = &syscall.SysProcAttr{CreationFlags: syscall.CREATE_NEW_PROCESS_GROUP}
+}
+
+// terminateProcess asks the process tree to close.
+// Windows has no SIGTERM, so this is only effective for windowed apps.
+func terminateProcess(p *os.Process) error {
+	return exec.Command("taskkill", "/T", "/PID", strconv.Itoa(p.Pid)).Run()
+}
+
+// interruptProcess asks the process tree to close, as terminateProcess.
+func interruptProcess(p *os.Process) error {
+	return terminateProcess(p)
+}
+
+// killProcessGroup forcefully kills the process tree.
+func killProcessGroup(p *os.Process) error {
+	if err := exec.Command("taskkill", "/T", "/F", "/PID", strconv.Itoa(p.Pid)).Run(); err != nil {
+		// The tree may already be gone, fall back to the process itself.
+		if err := p.Kill(); err != nil && !errors.Is(err, os.ErrProcessDone) {
+			return err
+		}
+	}
+	return nil
+}
+
+// reloadSignal asks the app to reload its templates.
+// Windows has no SIGHUP, use the HTTP notification instead.
+func reloadSignal(p *os.Process) error {
+	return errors.New("signals are not supported on Windows, set harness.templates.notify to http")
+}
@@ -0,0 +1,84 @@
+package harness
+
+import (
+	"crypto/tls"
+	"net"
+	"net/http"
+	"strings"
+
+	"golang.org/x/net/http2"
+)
+
+// protocolTransport forwards requests to the app using the protocol they were
+// made with.  Depending on harness.proxy.http2, HTTP/2 requests are forwarded
+// over HTTP/2 (h2c if the app doesn't use TLS):
+//   - "auto"   only gRPC requests (the default)
+//   - "always" every HTTP/2 request
+//   - "never"  none, everything is forwarded over HTTP/1.1
+//
+// Whether the app uses TLS is taken from the scheme of each request, as it may
+// change when the configuration is reloaded.
+type protocolTransport struct {
+	h1   http.RoundTripper
+	h2   http.RoundTripper // HTTP/2 over TLS
+	h2c  http.RoundTripper // HTTP/2 without TLS
+	mode string
+}
+
+func newProtocolTransport(mode string) *protocolTransport {
+	h1 := &http.Transport{TLSClientConfig: insecureTLSConfig()}
+	h2 := &http2.Transport{TLSClientConfig: insecureTLSConfig()}
+	h2c := &http2.Transport{
+		AllowHTTP: true,
+		DialTLS: func(network, addr string, cfg *tls.Config) (net.Conn, error) {
+			return net.Dial(network, addr)
+		},
+	}
+
+	return &protocolTransport{
+		h1:   h1,
+		h2:   h2,
+		h2c:  h2c,
+		mode: mode,
+	}
+}
+
+func (t *protocolTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if req.ProtoMajor == 2 && t.forwardHTTP2(req) {
+		if req.URL.Scheme == "https" {
+			return t.h2.RoundTrip(req)
+		}
+		return t.h2c.RoundTrip(req)
+	}
+	return t.h1.RoundTrip(req)
+}
+
+// insecureTLSConfig returns the configuration of the TLS connections to the
+// app, the services of a workspace and the upstreams of the proxy routes.
+// The harness isn't used in production, and they often have self-signed
+// certificates in development, so certificates aren't verified.
+func insecureTLSConfig() *tls.Config {
+	return &tls.Config{InsecureSkipVerify: true}
+}
+
+// setProxyTarget rewrites a request proxied by the harness to be sent to host
+// with the given scheme.
+func setProxyTarget(req *http.Request, scheme, host string) {
+	req.URL.Scheme = scheme
+	req.URL.Host = host
+	if _, ok := req.Header["User-Agent"]; !ok {
+		// explicitly disable User-Agent so it's not set to default value
+		req.Header.Set("User-Agent", "")
+	}
+}
+
+func (t *protocolTransport) forwardHTTP2(req *http.Request) bool {
+	switch t.mode {
+	case "always":
+		return true
+	case "never":
+		return false
+	default:
+		return strings.HasPrefix(req.Header.Get("Content-Type"), "application/grpc")
+	}
+}
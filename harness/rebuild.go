@@ -0,0 +1,207 @@
+package harness
+
+import (
+	"fmt"
+	"html"
+	"net/http"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"go.uber.org/zap"
+
+	"github.com/kenorld/egret-core"
+)
+
+// notifyInterval is how often change events are flushed from the watcher.
+const notifyInterval = 100 * time.Millisecond
+
+// rebuildingPage is served to browsers while there is no healthy build to
+// proxy to.  It refreshes itself until the build is done.
+const rebuildingPage = `<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<meta http-equiv="refresh" content="1">
+<title>Rebuilding…</title>
+<style>
+body { font-family: sans-serif; color: #555; text-align: center; margin-top: 20%%; }
+</style>
+</head>
+<body>
+<h1>Rebuilding…</h1>
+<p>%s will be back in a moment.</p>
+</body>
+</html>
+`
+
+// notifyLoop flushes change events in the background.  Changes end up in
+// Refresh, which schedules a rebuild.
+func (h *Harness) notifyLoop() {
+	for range time.Tick(notifyInterval) {
+		watcher.Notify()
+	}
+}
+
+// Actions taken on a change, in increasing order of cost.
+const (
+	actionNone            int32 = iota
+	actionReloadAssets          // rebuild the asset bundles and reload the browsers
+	actionReloadTemplates       // reload the browsers, leaving the app running
+	actionRestart               // restart the current binary
+	actionRebuild               // rebuild the app and restart it
+)
+
+// schedule marks the app as rebuilding and queues the given action.
+// Actions requested while one is already queued are coalesced into the most
+// expensive of them.
+func (h *Harness) schedule(action int32) {
+	for {
+		current := atomic.LoadInt32(&h.pendingAction)
+		if action <= current || atomic.CompareAndSwapInt32(&h.pendingAction, current, action) {
+			break
+		}
+	}
+	atomic.StoreInt64(&h.lastChange, time.Now().UnixNano())
+	h.startBuilding()
+	select {
+	case h.pending <- struct{}{}:
+	default:
+	}
+}
+
+// startBuilding flags a build as in progress, if it isn't already.
+func (h *Harness) startBuilding() {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if !h.building {
+		h.building = true
+		h.ready = make(chan struct{})
+	}
+}
+
+// rebuildLoop runs queued actions one at a time, once no change has been
+// seen for the harness.rebuild.debounce period.
+func (h *Harness) rebuildLoop(debounce time.Duration) {
+	for range h.pending {
+		h.startBuilding()
+		for {
+			wait := debounce - time.Since(time.Unix(0, atomic.LoadInt64(&h.lastChange)))
+			if wait <= 0 {
+				break
+			}
+			time.Sleep(wait)
+		}
+
+		err := h.runAction(atomic.SwapInt32(&h.pendingAction, actionNone))
+
+		h.mu.Lock()
+		h.lastError = err
+		h.building = false
+		close(h.ready)
+		h.mu.Unlock()
+
+		if err != nil {
+			h.logger.Error("Rebuild failed", zap.String("error", err.Error()))
+		}
+	}
+}
+
+// runAction reloads the configuration if it changed, rebuilds the asset
+// bundles whose sources changed, and then takes action.
+func (h *Harness) runAction(action int32) *egret.Error {
+	if atomic.SwapInt32(&h.configChanged, 0) == 1 {
+		if err := h.reloadConfig(); err != nil {
+			return err
+		}
+	}
+	if action >= actionRebuild {
+		// The bundles are built after the pre-build hooks, which may
+		// generate their sources.
+		return h.refresh()
+	}
+
+	// Bundles are built first, so that they are ready when the app starts.
+	urlsChanged, err := h.buildAssets()
+	if err != nil && action == actionReloadAssets {
+		// Nothing to reload, and the app is as broken or healthy as it was.
+		h.mu.Lock()
+		lastError := h.lastError
+		h.mu.Unlock()
+		return lastError
+	}
+	if urlsChanged && action < actionRestart {
+		// The app reads the new manifest when it starts.
+		action = actionRestart
+	}
+
+	switch action {
+	case actionReloadAssets:
+		return h.reloadAssets()
+	case actionReloadTemplates:
+		return h.reloadTemplates()
+	case actionRestart:
+		return h.restart()
+	default:
+		return h.refresh()
+	}
+}
+
+// buildAssets builds the asset bundles whose sources changed, and reports
+// whether the URL of any changed.  A failed asset build is reported on its
+// own, as the app can serve without them, and the stale bundles are built
+// again on the next change.
+func (h *Harness) buildAssets() (bool, *egret.Error) {
+	h.mu.Lock()
+	assets := h.assets
+	h.mu.Unlock()
+	urlsChanged, err := assets.Build()
+	h.warn(assetErrorName, err)
+	return urlsChanged, err
+}
+
+// waitForBuild handles requests arriving while a rebuild is in progress and
+// there is no healthy build to serve them from.  Browsers get a page that
+// refreshes itself, other clients get a 503 unless harness.rebuild.hold is
+// set, in which case they wait for the build to finish.
+// It returns false if the request has been answered.
+func (h *Harness) waitForBuild(w http.ResponseWriter, r *http.Request) bool {
+	h.mu.Lock()
+	building, ready, hold := h.building, h.ready, h.hold
+	serving := h.app != nil && h.lastError == nil
+	h.mu.Unlock()
+
+	if !building || serving {
+		return true
+	}
+
+	if isHTMLRequest(r) {
+		w.Header().Set("Content-Type", "text/html; charset=utf-8")
+		w.Header().Set("Cache-Control", "no-cache")
+		w.WriteHeader(http.StatusServiceUnavailable)
+		name := appName()
+		if name == "" {
+			name = "The app"
+		}
+		fmt.Fprintf(w, rebuildingPage, html.EscapeString(name))
+		return false
+	}
+
+	if hold {
+		select {
+		case <-ready:
+			return true
+		case <-r.Context().Done():
+			return false
+		}
+	}
+
+	w.Header().Set("Retry-After", "1")
+	http.Error(w, "Rebuilding, retry shortly.", http.StatusServiceUnavailable)
+	return false
+}
+
+// isHTMLRequest reports whether the request comes from a browser expecting a page.
+func isHTMLRequest(r *http.Request) bool {
+	return strings.Contains(r.Header.Get("Accept"), "text/html")
+}
@@ -0,0 +1,250 @@
+package harness
+
+import (
+	"fmt"
+	"io/ioutil"
+	"mime"
+	"net/http"
+	"net/http/httputil"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"go.uber.org/zap"
+	"gopkg.in/yaml.v2"
+
+	"github.com/kenorld/egret-core"
+)
+
+// stubScheme prefixes the targets of routes served from a stub file.
+const stubScheme = "stub:"
+
+// proxyRoute forwards the requests under a path prefix to another upstream
+// than the app, as set by harness.proxy.routes, a map of prefixes to targets
+// or one route per line or list item:
+//
+//	/api/legacy: http://localhost:4000
+//	/api/payments: http://localhost:4100/v2/
+//	/api/search: stub:stubs/search.yaml
+//
+// Requests are forwarded with their path as is, unless the URL has a path,
+// which then replaces the prefix.  "stub:" routes are answered by the harness
+// itself, from the canned responses of a YAML file relative to the app.  The
+// longest matching prefix wins, and routes keep working while the app is
+// being rebuilt or is broken.
+type proxyRoute struct {
+	prefix  string
+	target  string
+	handler http.Handler
+}
+
+func newProxyRoutes(logger *zap.Logger) ([]*proxyRoute, error) {
+	lines, err := configEntries("harness.proxy.routes")
+	if err != nil {
+		return nil, err
+	}
+	var routes []*proxyRoute
+	for _, line := range lines {
+		i := strings.Index(line, ":")
+		if i < 0 {
+			return nil, fmt.Errorf("harness.proxy.routes: %q is not a \"prefix: target\" line", line)
+		}
+		route := &proxyRoute{
+			prefix: strings.TrimSuffix(strings.TrimSpace(line[:i]), "/"),
+			target: strings.TrimSpace(line[i+1:]),
+		}
+		if !strings.HasPrefix(route.prefix, "/") || isAdminPath(route.prefix) {
+			return nil, fmt.Errorf("harness.proxy.routes: invalid prefix %q", line[:i])
+		}
+
+		if strings.HasPrefix(route.target, stubScheme) {
+			filename := strings.TrimSpace(strings.TrimPrefix(route.target, stubScheme))
+			if !filepath.IsAbs(filename) {
+				filename = filepath.Join(egret.BasePath, filename)
+			}
+			route.handler = &stubServer{prefix: route.prefix, filename: filename, logger: logger}
+		} else {
+			target, err := url.Parse(route.target)
+			if err != nil || (target.Scheme != "http" && target.Scheme != "https") || target.Host == "" {
+				return nil, fmt.Errorf("harness.proxy.routes: %s: invalid upstream URL %q", route.prefix, route.target)
+			}
+			route.handler = newUpstreamProxy(route, target)
+		}
+		logger.Info("Proxy route", zap.String("prefix", route.prefix+"/"), zap.String("target", route.target))
+		routes = append(routes, route)
+	}
+	return routes, nil
+}
+
+// matchRoute returns the route with the longest prefix matching p, or nil.
+func matchRoute(routes []*proxyRoute, p string) *proxyRoute {
+	var best *proxyRoute
+	for _, route := range routes {
+		if p == route.prefix || strings.HasPrefix(p, route.prefix+"/") {
+			if best == nil || len(route.prefix) > len(best.prefix) {
+				best = route
+			}
+		}
+	}
+	return best
+}
+
+func newUpstreamProxy(route *proxyRoute, target *url.URL) http.Handler {
+	return &httputil.ReverseProxy{
+		Director: func(req *http.Request) {
+			setProxyTarget(req, target.Scheme, target.Host)
+			req.Host = target.Host
+			if target.Path != "" {
+				req.URL.Path = strings.TrimSuffix(target.Path, "/") + strings.TrimPrefix(req.URL.Path, route.prefix)
+				if req.URL.Path == "" {
+					req.URL.Path = "/"
+				}
+				req.URL.RawPath = ""
+			}
+		},
+		Transport: &http.Transport{
+			Proxy:           http.ProxyFromEnvironment,
+			TLSClientConfig: insecureTLSConfig(),
+		},
+		FlushInterval: -1,
+		ErrorHandler: func(w http.ResponseWriter, r *http.Request, err error) {
+			http.Error(w, fmt.Sprintf("Proxy route %s/ to %s: %s", route.prefix, route.target, err), http.StatusBadGateway)
+		},
+	}
+}
+
+// stubResponse is a canned response of a stub file, e.g.
+//
+//	responses:
+//	  - method: GET          # any method if empty
+//	    path: /users/*       # glob matched against the path after the prefix,
+//	                         # "**" matching any number of directories
+//	    status: 200          # 200 by default
+//	    headers:
+//	      Content-Type: application/json
+//	    body: '{"id": 1}'    # or
+//	    file: users.json     # relative to the stub file
+//	    delay: 200ms
+//
+// The first matching response is sent.
+type stubResponse struct {
+	Method  string            `yaml:"method"`
+	Path    string            `yaml:"path"`
+	Status  int               `yaml:"status"`
+	Headers map[string]string `yaml:"headers"`
+	Body    string            `yaml:"body"`
+	File    string            `yaml:"file"`
+	Delay   string            `yaml:"delay"`
+
+	delay time.Duration
+}
+
+// stubServer answers the requests of a route from a stub file, read again
+// whenever it changes.
+type stubServer struct {
+	prefix   string
+	filename string
+	logger   *zap.Logger
+
+	mu        sync.Mutex
+	modTime   time.Time
+	responses []*stubResponse
+}
+
+func (s *stubServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	responses, err := s.load()
+	if err != nil {
+		s.logger.Error("Failed to load stub file", zap.String("file", s.filename), zap.Error(err))
+		http.Error(w, fmt.Sprintf("Stub file %s: %s", s.filename, err), http.StatusInternalServerError)
+		return
+	}
+
+	p := "/" + strings.TrimLeft(strings.TrimPrefix(r.URL.Path, s.prefix), "/")
+	for _, resp := range responses {
+		if resp.Method != "" && !strings.EqualFold(resp.Method, r.Method) {
+			continue
+		}
+		if resp.Path != "" && !matchSegments(strings.Split(strings.TrimPrefix(resp.Path, "/"), "/"), strings.Split(p[1:], "/")) {
+			continue
+		}
+		s.write(w, resp)
+		return
+	}
+	http.Error(w, fmt.Sprintf("No stub for %s %s in %s", r.Method, p, s.filename), http.StatusNotFound)
+}
+
+func (s *stubServer) write(w http.ResponseWriter, resp *stubResponse) {
+	body := []byte(resp.Body)
+	contentType := ""
+	if resp.File != "" {
+		filename := resp.File
+		if !filepath.IsAbs(filename) {
+			filename = filepath.Join(filepath.Dir(s.filename), filename)
+		}
+		data, err := ioutil.ReadFile(filename)
+		if err != nil {
+			http.Error(w, fmt.Sprintf("Stub file %s: %s", s.filename, err), http.StatusInternalServerError)
+			return
+		}
+		body, contentType = data, mime.TypeByExtension(filepath.Ext(filename))
+	} else if trimmed := strings.TrimSpace(resp.Body); strings.HasPrefix(trimmed, "{") || strings.HasPrefix(trimmed, "[") {
+		contentType = "application/json; charset=utf-8"
+	}
+
+	if resp.delay > 0 {
+		time.Sleep(resp.delay)
+	}
+	if contentType != "" {
+		w.Header().Set("Content-Type", contentType)
+	}
+	for name, value := range resp.Headers {
+		w.Header().Set(name, value)
+	}
+	status := resp.Status
+	if status == 0 {
+		status = http.StatusOK
+	}
+	w.WriteHeader(status)
+	w.Write(body)
+}
+
+// load returns the responses of the stub file, reading it again if it
+// changed.
+func (s *stubServer) load() ([]*stubResponse, error) {
+	info, err := os.Stat(s.filename)
+	if err != nil {
+		return nil, err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.responses != nil && info.ModTime().Equal(s.modTime) {
+		return s.responses, nil
+	}
+
+	data, err := ioutil.ReadFile(s.filename)
+	if err != nil {
+		return nil, err
+	}
+	var stubs struct {
+		Responses []*stubResponse `yaml:"responses"`
+	}
+	if err := yaml.UnmarshalStrict(data, &stubs); err != nil {
+		return nil, err
+	}
+	responses := stubs.Responses
+	for i, resp := range responses {
+		if resp.Body != "" && resp.File != "" {
+			return nil, fmt.Errorf("response %d: both body and file are set", i+1)
+		}
+		if resp.Delay != "" {
+			if resp.delay, err = time.ParseDuration(resp.Delay); err != nil {
+				return nil, fmt.Errorf("response %d: delay: %s", i+1, err)
+			}
+		}
+	}
+	s.modTime, s.responses = info.ModTime(), responses
+	return responses, nil
+}
@@ -0,0 +1,170 @@
+package harness
+
+import (
+	"bytes"
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/kenorld/egret-core"
+)
+
+const (
+	// maxSanitizerReports is the number of reports kept per app instance.
+	maxSanitizerReports = 20
+	// maxReportLines is the number of lines kept per report.
+	maxReportLines = 200
+)
+
+var (
+	// sanitizerStartPattern matches the first line of an AddressSanitizer or
+	// MemorySanitizer report, e.g.
+	// "==1234==ERROR: AddressSanitizer: heap-buffer-overflow on address ...".
+	sanitizerStartPattern = regexp.MustCompile(`^==\d+==(?:ERROR|WARNING): (\w+Sanitizer): (.*)$`)
+	// sanitizerEndPattern matches the last line of such a report.
+	sanitizerEndPattern = regexp.MustCompile(`^(?:==\d+==ABORTING|SUMMARY: \w+Sanitizer)`)
+	// reportLocationPattern matches the location line of a Go frame in a race
+	// report, e.g. "      /go/src/app/routes/app.go:42 +0x1d".
+	reportLocationPattern = regexp.MustCompile(`^\s+(.+\.go):(\d+)(?: \+0x[0-9a-f]+)?$`)
+	// sanitizerFramePattern matches a frame of a sanitizer report,
+	// e.g. "    #0 0x4a1b2c in main.main /go/src/app/main.go:12".
+	sanitizerFramePattern = regexp.MustCompile(`^\s+#\d+ 0x[0-9a-f]+ in (\S+) (.+\.go):(\d+)`)
+)
+
+// SanitizerReport is a report of the race detector, or of the address or
+// memory sanitizer, parsed from the app's stderr.
+type SanitizerReport struct {
+	Kind    string       // "DATA RACE", "AddressSanitizer" or "MemorySanitizer"
+	Summary string       // what happened
+	Text    string       // the whole report
+	Frames  []StackFrame // frames of the report, in order
+}
+
+// sanitizerScanner is an io.Writer picking reports out of the app's stderr
+// as it is written.
+type sanitizerScanner struct {
+	mu      sync.Mutex
+	partial []byte   // incomplete last line
+	lines   []string // lines of the report being read, nil if none
+	kind    string
+	reports []*SanitizerReport
+	notify  chan struct{} // signalled when a report is complete
+}
+
+func newSanitizerScanner() *sanitizerScanner {
+	return &sanitizerScanner{notify: make(chan struct{}, 1)}
+}
+
+func (s *sanitizerScanner) Write(p []byte) (int, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.partial = append(s.partial, p...)
+	for {
+		i := bytes.IndexByte(s.partial, '\n')
+		if i < 0 {
+			break
+		}
+		s.scanLine(strings.TrimRight(string(s.partial[:i]), "\r"))
+		s.partial = s.partial[i+1:]
+	}
+	return len(p), nil
+}
+
+func (s *sanitizerScanner) scanLine(line string) {
+	if s.lines == nil {
+		switch {
+		case line == "WARNING: DATA RACE":
+			s.kind, s.lines = "DATA RACE", []string{line}
+		case sanitizerStartPattern.MatchString(line):
+			s.kind, s.lines = sanitizerStartPattern.FindStringSubmatch(line)[1], []string{line}
+		}
+		return
+	}
+
+	if s.kind == "DATA RACE" && strings.HasPrefix(line, "==================") {
+		s.finish()
+		return
+	}
+	if len(s.lines) < maxReportLines {
+		s.lines = append(s.lines, line)
+	}
+	if s.kind != "DATA RACE" && sanitizerEndPattern.MatchString(line) {
+		s.finish()
+	}
+}
+
+// finish records the report being read.
+func (s *sanitizerScanner) finish() {
+	s.reports = append(s.reports, parseSanitizerReport(s.kind, s.lines))
+	if len(s.reports) > maxSanitizerReports {
+		s.reports = s.reports[1:]
+	}
+	s.kind, s.lines = "", nil
+	select {
+	case s.notify <- struct{}{}:
+	default:
+	}
+}
+
+// Reports returns the reports read so far.
+func (s *sanitizerScanner) Reports() []*SanitizerReport {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]*SanitizerReport(nil), s.reports...)
+}
+
+func parseSanitizerReport(kind string, lines []string) *SanitizerReport {
+	r := &SanitizerReport{Kind: kind, Text: strings.Join(lines, "\n")}
+	if m := sanitizerStartPattern.FindStringSubmatch(lines[0]); m != nil {
+		r.Summary = m[2]
+	}
+
+	for i, line := range lines {
+		if r.Summary == "" && i > 0 && strings.TrimSpace(line) != "" {
+			// Race reports start with the access, e.g.
+			// "Write at 0x00c0000a4010 by goroutine 7:".
+			r.Summary = strings.TrimSuffix(strings.TrimSpace(line), ":")
+		}
+		if m := sanitizerFramePattern.FindStringSubmatch(line); m != nil {
+			n, _ := strconv.Atoi(m[3])
+			r.Frames = append(r.Frames, StackFrame{Func: m[1], File: m[2], Line: n})
+			continue
+		}
+		if m := reportLocationPattern.FindStringSubmatch(line); m != nil && i > 0 {
+			n, _ := strconv.Atoi(m[2])
+			r.Frames = append(r.Frames, StackFrame{Func: strings.TrimSpace(lines[i-1]), File: m[1], Line: n})
+		}
+	}
+	return r
+}
+
+// sanitizerError returns an Error rendering the last of reports, pointing at
+// the innermost frame in the app's source.
+func sanitizerError(reports []*SanitizerReport) *egret.Error {
+	r := reports[len(reports)-1]
+	err := &egret.Error{
+		SourceType: "Go code",
+		Name:       "sanitizer_report",
+		Title:      r.Kind,
+		Summary:    r.Summary,
+	}
+	if r.Kind == "DATA RACE" {
+		err.Name, err.Title = "data_race", "Data Race"
+	}
+	if len(reports) > 1 {
+		err.Summary += fmt.Sprintf(" (and %d more reports)", len(reports)-1)
+	}
+	pointAt(err, appFrames(r.Frames))
+	return err
+}
+
+// SanitizerReports returns the reports of the race detector or sanitizers
+// the app printed so far.
+func (cmd AppCmd) SanitizerReports() []*SanitizerReport {
+	if cmd.sanitizer == nil {
+		return nil
+	}
+	return cmd.sanitizer.Reports()
+}
@@ -0,0 +1,31 @@
+package harness
+
+import "sync"
+
+// tailBuffer is an io.Writer keeping only the last bytes written to it.
+type tailBuffer struct {
+	mu   sync.Mutex
+	buf  []byte
+	size int
+}
+
+func newTailBuffer(size int) *tailBuffer {
+	return &tailBuffer{size: size}
+}
+
+func (t *tailBuffer) Write(p []byte) (int, error) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.buf = append(t.buf, p...)
+	if over := len(t.buf) - t.size; over > 0 {
+		t.buf = append(t.buf[:0], t.buf[over:]...)
+	}
+	return len(p), nil
+}
+
+// Bytes returns a copy of the buffered output.
+func (t *tailBuffer) Bytes() []byte {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return append([]byte(nil), t.buf...)
+}
@@ -0,0 +1,217 @@
+package harness
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"text/template/parse"
+	"time"
+
+	"go.uber.org/zap"
+
+	"github.com/kenorld/egret-core"
+)
+
+// templatesReloadPath is the default route of the app asked to reload its
+// templates.  It is under the harness prefix, so browsers can't reach it
+// through the proxy.
+const templatesReloadPath = "/@harness/templates/reload"
+
+// templateErrorName is the name of errors reported for invalid templates.
+const templateErrorName = "template_error"
+
+// templateErrorPattern extracts the line of a parse error,
+// "template: name:line: message".
+var templateErrorPattern = regexp.MustCompile(`^template: [^:]*:(\d+):`)
+
+// viewListener watches the views directories.  Changed templates are
+// validated and reloaded by the app, which is never rebuilt for them.
+type viewListener struct {
+	h *Harness
+}
+
+// Refresh method schedules a template reload if any view changed.
+func (v *viewListener) Refresh() *egret.Error {
+	if v.h.views.empty() {
+		return nil
+	}
+	v.h.schedule(actionReloadTemplates)
+	return nil
+}
+
+// WatchDir method returns false for hidden directories
+// otherwise true
+func (v *viewListener) WatchDir(info os.FileInfo) bool {
+	return !strings.HasPrefix(info.Name(), ".")
+}
+
+// WatchFile method returns true for files inside a views directory, which
+// are recorded for the following Refresh, otherwise false
+func (v *viewListener) WatchFile(filename string) bool {
+	configMu.RLock()
+	defer configMu.RUnlock()
+	if strings.HasPrefix(filepath.Base(filename), ".") {
+		return false
+	}
+	if !strings.Contains(filepath.ToSlash(filename), "/views/") {
+		return false
+	}
+	v.h.views.add(filename)
+	return true
+}
+
+// viewSet holds the templates changed since they were last found valid.
+type viewSet struct {
+	mu    sync.Mutex
+	files map[string]bool
+}
+
+func newViewSet() *viewSet {
+	return &viewSet{files: make(map[string]bool)}
+}
+
+func (s *viewSet) add(filename string) {
+	s.mu.Lock()
+	s.files[filename] = true
+	s.mu.Unlock()
+}
+
+func (s *viewSet) empty() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return len(s.files) == 0
+}
+
+// validate parses every template in the set.  Valid ones are removed from it,
+// and the error of the first invalid one is returned.
+func (s *viewSet) validate() *egret.Error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	filenames := make([]string, 0, len(s.files))
+	for filename := range s.files {
+		filenames = append(filenames, filename)
+	}
+	sort.Strings(filenames)
+
+	var first *egret.Error
+	for _, filename := range filenames {
+		if err := validateTemplate(filename); err != nil {
+			if first == nil {
+				first = err
+			}
+			continue
+		}
+		delete(s.files, filename)
+	}
+	return first
+}
+
+// validateTemplate parses the template in filename, without checking that
+// the functions it calls exist as they are only known to the app.
+func validateTemplate(filename string) *egret.Error {
+	if !egret.ContainsString(configList("harness.templates.extensions", ".html, .tmpl, .tpl"), filepath.Ext(filename)) {
+		return nil
+	}
+	data, err := ioutil.ReadFile(filename)
+	if err != nil {
+		// Removed, nothing to validate.
+		return nil
+	}
+
+	left, right := templateDelims()
+	tree := parse.New(filepath.Base(filename))
+	tree.Mode = parse.SkipFuncCheck
+	if _, err := tree.Parse(string(data), left, right, make(map[string]*parse.Tree)); err != nil {
+		e := &egret.Error{
+			Name:       templateErrorName,
+			Title:      "Template Parse Error",
+			SourceType: "template",
+			Path:       filename,
+			Summary:    err.Error(),
+		}
+		if m := templateErrorPattern.FindStringSubmatch(err.Error()); m != nil {
+			e.Line, _ = strconv.Atoi(m[1])
+			e.SourceLines = strings.Split(string(data), "\n")
+		}
+		return e
+	}
+	return nil
+}
+
+// templateDelims returns the delimiters set by template.delimiters, a space
+// separated pair such as "[[ ]]", or the default ones.
+func templateDelims() (string, string) {
+	delims := strings.Fields(egret.Config.GetStringDefault("template.delimiters", ""))
+	if len(delims) != 2 {
+		return "", ""
+	}
+	return delims[0], delims[1]
+}
+
+// reloadTemplates validates the changed templates, has the app reload them
+// and reloads the browsers.  Invalid templates are reported on the error page
+// until they are fixed, unless the app itself is broken.
+func (h *Harness) reloadTemplates() *egret.Error {
+	err := h.views.validate()
+
+	h.mu.Lock()
+	app, lastError := h.app, h.lastError
+	h.mu.Unlock()
+	if lastError != nil && lastError.Name != templateErrorName {
+		// The app itself is broken, fixing templates doesn't change that.
+		return lastError
+	}
+	if err != nil {
+		return err
+	}
+
+	if app != nil {
+		if err := h.notifyTemplates(app); err != nil {
+			h.logger.Warn("Failed to have the app reload its templates", zap.Error(err))
+		}
+	}
+	if h.reload != nil {
+		h.reload.Broadcast()
+	}
+	return nil
+}
+
+// notifyTemplates asks the app to reload its templates, as set by
+// harness.templates.notify:
+//   - "none"   leave it to the app, e.g. when it reads them on each request
+//     in dev mode (the default)
+//   - "http"   POST to harness.templates.path, with an empty body.  The app
+//     must implement the route, reload its templates and answer with a 2xx
+//     status once done, or a 4xx or 5xx one if it failed.
+//   - "signal" send it SIGHUP.  The app must handle it with signal.Notify
+//     and reload its templates, as the signal kills it otherwise.
+func (h *Harness) notifyTemplates(app *App) error {
+	switch egret.Config.GetStringDefault("harness.templates.notify", "none") {
+	case "none":
+		return nil
+	case "signal":
+		return reloadSignal(app.cmd.Process)
+	}
+
+	u := *h.target.Load().(*url.URL)
+	u.Path = egret.Config.GetStringDefault("harness.templates.path", templatesReloadPath)
+	client := &http.Client{Transport: h.proxy.Transport, Timeout: 5 * time.Second}
+	resp, err := client.Post(u.String(), "text/plain", nil)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode >= 400 {
+		return fmt.Errorf("%s answered %s", u.Path, resp.Status)
+	}
+	return nil
+}
@@ -0,0 +1,262 @@
+package harness
+
+import (
+	"fmt"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/kenorld/egret-core"
+	"github.com/spf13/cast"
+)
+
+// watchRule maps files matching a glob to the action taken when they change.
+type watchRule struct {
+	pattern string
+	action  int32 // actionNone means the file is ignored
+}
+
+// watchConfig decides what happens when a file changes, from:
+//
+//	watch.include  files that trigger a rebuild (default "*.go")
+//	watch.exclude  files and directories that are not watched
+//	               (default "views, vendor, node_modules", views are
+//	               watched separately and reloaded without a rebuild)
+//	watch.actions  "glob:action" pairs overriding the above, where action is
+//	               one of rebuild, restart-only, reload-templates or ignore
+//
+// All are lists of globs, as YAML lists or comma separated strings, matched
+// against paths relative to the app's base path.  "**" matches any number of
+// directories, and a glob without a slash matches any file or directory
+// name.  Hidden directories, whose name starts with "." or "_", are never
+// watched.
+type watchConfig struct {
+	include []string
+	exclude []string
+	rules   []watchRule
+}
+
+func newWatchConfig() (*watchConfig, error) {
+	wc := &watchConfig{
+		include: configList("watch.include", "*.go"),
+		exclude: configList("watch.exclude", "views, vendor, node_modules"),
+	}
+	for _, item := range configList("watch.actions", "") {
+		i := strings.LastIndex(item, ":")
+		if i < 0 {
+			return nil, fmt.Errorf("watch.actions: %q is not a glob:action pair", item)
+		}
+		action, err := parseAction(strings.TrimSpace(item[i+1:]))
+		if err != nil {
+			return nil, err
+		}
+		wc.rules = append(wc.rules, watchRule{strings.TrimSpace(item[:i]), action})
+	}
+	return wc, nil
+}
+
+func parseAction(name string) (int32, error) {
+	switch name {
+	case "rebuild":
+		return actionRebuild, nil
+	case "restart", "restart-only":
+		return actionRestart, nil
+	case "reload-templates":
+		return actionReloadTemplates, nil
+	case "ignore":
+		return actionNone, nil
+	}
+	return actionNone, fmt.Errorf("watch.actions: unknown action %q", name)
+}
+
+// watchDir reports whether the directory with the given name is watched.
+// Only exclude globs naming a directory can be applied here.
+func (wc *watchConfig) watchDir(name string) bool {
+	if isHiddenDir(name) {
+		return false
+	}
+	for _, pattern := range wc.exclude {
+		pattern = strings.TrimSuffix(strings.TrimPrefix(pattern, "**/"), "/**")
+		if strings.Contains(pattern, "/") {
+			continue
+		}
+		if ok, _ := path.Match(pattern, name); ok {
+			return false
+		}
+	}
+	return true
+}
+
+// action returns what to do when filename changes.
+func (wc *watchConfig) action(filename string) int32 {
+	name := relativeToApp(filename)
+	for _, rule := range wc.rules {
+		if matchGlob(rule.pattern, name) {
+			return rule.action
+		}
+	}
+	for _, pattern := range wc.exclude {
+		if matchGlob(pattern, name) {
+			return actionNone
+		}
+	}
+	for _, pattern := range wc.include {
+		if matchGlob(pattern, name) {
+			return actionRebuild
+		}
+	}
+	return actionNone
+}
+
+// relativeToApp returns filename as a slash separated path relative to the
+// app's base path, or as an absolute one if it's outside of it.
+func relativeToApp(filename string) string {
+	if rel, err := filepath.Rel(egret.BasePath, filename); err == nil && !strings.HasPrefix(rel, "..") {
+		return filepath.ToSlash(rel)
+	}
+	return filepath.ToSlash(filename)
+}
+
+// matchGlob reports whether the slash separated name matches pattern.
+// "**" matches any number of directories.  A pattern without a slash matches
+// the file name or any of the directory names in name.
+func matchGlob(pattern, name string) bool {
+	if !strings.Contains(pattern, "/") {
+		for _, segment := range strings.Split(name, "/") {
+			if ok, _ := path.Match(pattern, segment); ok {
+				return true
+			}
+		}
+		return false
+	}
+	return matchSegments(strings.Split(strings.TrimPrefix(pattern, "/"), "/"), strings.Split(name, "/"))
+}
+
+func matchSegments(pattern, name []string) bool {
+	for len(pattern) > 0 {
+		if pattern[0] == "**" {
+			for i := 0; i <= len(name); i++ {
+				if matchSegments(pattern[1:], name[i:]) {
+					return true
+				}
+			}
+			return false
+		}
+		if len(name) == 0 {
+			return false
+		}
+		if ok, _ := path.Match(pattern[0], name[0]); !ok {
+			return false
+		}
+		pattern, name = pattern[1:], name[1:]
+	}
+	return len(name) == 0
+}
+
+// configList returns the list configured for key, either as a YAML list or
+// as a comma or newline separated string.
+func configList(key, def string) []string {
+	var items []string
+	switch value := egret.Config.Get(key).(type) {
+	case nil:
+		items = splitList(def)
+	case string:
+		items = splitList(value)
+	default:
+		items = cast.ToStringSlice(value)
+	}
+	var list []string
+	for _, item := range items {
+		if item = strings.TrimSpace(item); item != "" {
+			list = append(list, item)
+		}
+	}
+	return list
+}
+
+func splitList(s string) []string {
+	return strings.FieldsFunc(s, func(r rune) bool { return r == ',' || r == '\n' })
+}
+
+// configLines returns the lines configured for key, either as a YAML list or
+// as a newline separated string, for items which may contain commas such as
+// commands.  Blank lines and those starting with "#" are skipped.
+func configLines(key string) ([]string, error) {
+	var items []string
+	switch value := egret.Config.Get(key).(type) {
+	case nil:
+	case string:
+		items = strings.Split(value, "\n")
+	case []string:
+		items = value
+	case []interface{}:
+		var err error
+		if items, err = toStrings(key, value); err != nil {
+			return nil, err
+		}
+	default:
+		return nil, fmt.Errorf("%s: expected a list or a string, got %v", key, value)
+	}
+	var lines []string
+	for _, item := range items {
+		if item = strings.TrimSpace(item); item != "" && !strings.HasPrefix(item, "#") {
+			lines = append(lines, item)
+		}
+	}
+	return lines, nil
+}
+
+// configEntries returns the "name: value" lines configured for key, as
+// configLines does, or built from a YAML map, in the order of the names.
+// List values of a map are joined with commas.
+func configEntries(key string) ([]string, error) {
+	value := egret.Config.Get(key)
+	switch value.(type) {
+	case nil, string, []string, []interface{}:
+		return configLines(key)
+	}
+	entries, err := cast.ToStringMapE(value)
+	if err != nil {
+		return nil, fmt.Errorf("%s: expected a map, a list or a string, got %v", key, value)
+	}
+	names := make([]string, 0, len(entries))
+	for name := range entries {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	var lines []string
+	for _, name := range names {
+		var items []string
+		switch v := entries[name].(type) {
+		case []string:
+			items = v
+		case []interface{}:
+			items, err = toStrings(key+": "+name, v)
+		default:
+			var item string
+			if item, err = cast.ToStringE(v); err != nil {
+				err = fmt.Errorf("%s: %s: invalid value %v", key, name, v)
+			}
+			items = []string{item}
+		}
+		if err != nil {
+			return nil, err
+		}
+		lines = append(lines, name+": "+strings.Join(items, ", "))
+	}
+	return lines, nil
+}
+
+// toStrings converts the items of a YAML list to strings.
+func toStrings(key string, list []interface{}) ([]string, error) {
+	items := make([]string, 0, len(list))
+	for _, item := range list {
+		s, err := cast.ToStringE(item)
+		if err != nil {
+			return nil, fmt.Errorf("%s: invalid item %v, expected a string", key, item)
+		}
+		items = append(items, s)
+	}
+	return items, nil
+}
@@ -0,0 +1,425 @@
+package harness
+
+import (
+	"bytes"
+	"crypto/tls"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httputil"
+	"net/url"
+	"os"
+	"os/exec"
+	"os/signal"
+	"path"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"go.uber.org/zap"
+	"golang.org/x/net/http2"
+	"golang.org/x/net/http2/h2c"
+	"gopkg.in/yaml.v2"
+)
+
+// Workspace is a set of Egret apps run together by a single "egret run",
+// described by a YAML file such as:
+//
+//	listen: ":9000"
+//	services:
+//	  - name: web
+//	    import: github.com/acme/web
+//	    hosts: [localhost, "*.web.localhost"]
+//	  - name: api
+//	    import: github.com/acme/api
+//	    mode: dev
+//	    port: 9002
+//	    paths: [/api]
+//	    strip: true
+//	  - name: worker
+//	    dir: worker
+//
+// Each service is run by a harness of its own, as "egret run" would run it, so
+// it is built, watched and rebuilt independently of the others.  Requests are
+// routed to the service whose hosts match the Host header, preferring the one
+// with the longest matching path prefix.  Services without hosts match any
+// host, and services without paths match any path, but services with neither
+// (workers) are not routed to.
+//
+// The services are run with the -race, -msan, -asan and -log-level flags of
+// the workspace's "egret run", and with -debug under Delve sessions listening
+// on consecutive ports from -debug-port.
+type Workspace struct {
+	Listen   string     `yaml:"listen"`
+	HTTP2    string     `yaml:"http2"` // as harness.proxy.http2
+	Services []*Service `yaml:"services"`
+
+	BuildFlags []string // "go build" flags of the services, e.g. -race
+	Debug      bool     // run the services under Delve
+	DebugPort  int      // port of the first service's Delve session, 2345 if zero
+
+	logger *zap.Logger
+}
+
+// Service is an app of a Workspace.
+type Service struct {
+	Name   string   `yaml:"name"`
+	Import string   `yaml:"import"` // import path, empty for the app in Dir
+	Dir    string   `yaml:"dir"`    // working directory, relative to the workspace file
+	Mode   string   `yaml:"mode"`   // run mode, "dev" by default
+	Port   int      `yaml:"port"`   // port of the service's harness, free one by default
+	Hosts  []string `yaml:"hosts"`  // globs matched against the Host header
+	Paths  []string `yaml:"paths"`  // path prefixes
+	Strip  bool     `yaml:"strip"`  // strip the path prefix before forwarding
+
+	cmd      *exec.Cmd
+	done     chan struct{}
+	proxy    *httputil.ReverseProxy
+	reserved net.Listener // holds Port until the service starts
+
+	mu     sync.Mutex
+	probed string // scheme of the service's harness, empty until known
+}
+
+// LoadWorkspace method reads the workspace described by filename.
+func LoadWorkspace(filename string, logger *zap.Logger) (*Workspace, error) {
+	data, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return nil, err
+	}
+	ws := &Workspace{logger: logger}
+	if err := yaml.UnmarshalStrict(data, ws); err != nil {
+		return nil, fmt.Errorf("%s: %s", filename, err)
+	}
+	if len(ws.Services) == 0 {
+		return nil, fmt.Errorf("%s: no services", filename)
+	}
+	if ws.Listen == "" {
+		ws.Listen = ":9000"
+	}
+	if ws.HTTP2 == "" {
+		ws.HTTP2 = "auto"
+	}
+
+	base := filepath.Dir(filename)
+	names := make(map[string]bool)
+	for i, s := range ws.Services {
+		if s.Name == "" {
+			s.Name = fmt.Sprintf("service%d", i+1)
+		}
+		if names[s.Name] {
+			return nil, fmt.Errorf("%s: duplicate service %q", filename, s.Name)
+		}
+		names[s.Name] = true
+		if !filepath.IsAbs(s.Dir) {
+			s.Dir = filepath.Join(base, s.Dir)
+		}
+		if s.Mode == "" {
+			s.Mode = "dev"
+		}
+		if s.Port, s.reserved, err = reservePort(s.Port); err != nil {
+			return nil, fmt.Errorf("%s: service %q: %s", filename, s.Name, err)
+		}
+		for _, prefix := range s.Paths {
+			if !strings.HasPrefix(prefix, "/") {
+				return nil, fmt.Errorf("%s: service %q: path %q must start with /", filename, s.Name, prefix)
+			}
+		}
+	}
+	return ws, nil
+}
+
+// Run method starts every service and routes requests to them until the
+// workspace is interrupted.
+func (ws *Workspace) Run() {
+	exe, err := os.Executable()
+	if err != nil {
+		ws.logger.Fatal("Failed to find the egret executable", zap.Error(err))
+	}
+	ln, err := net.Listen("tcp", ws.Listen)
+	if err != nil {
+		if _, port, perr := net.SplitHostPort(ws.Listen); perr == nil {
+			n, _ := strconv.Atoi(port)
+			err = portError(n, err)
+		}
+		ws.logger.Fatal("Failed to start workspace proxy", zap.Error(err))
+	}
+
+	transport := newProtocolTransport(ws.HTTP2)
+	for i, s := range ws.Services {
+		if err := ws.start(s, exe, i); err != nil {
+			ws.stop()
+			ws.logger.Fatal("Failed to start service", zap.String("service", s.Name), zap.Error(err))
+		}
+		s.proxy = &httputil.ReverseProxy{
+			Director:      s.director,
+			Transport:     transport,
+			ErrorHandler:  s.proxyError,
+			FlushInterval: -1,
+		}
+	}
+
+	go func() {
+		ws.logger.Info("Workspace listening on address: " + ws.Listen)
+		server := &http.Server{Handler: h2c.NewHandler(ws, &http2.Server{})}
+		if err := server.Serve(ln); err != nil {
+			ws.stop()
+			ws.logger.Fatal("Failed to start workspace proxy", zap.Error(err))
+		}
+	}()
+
+	ch := make(chan os.Signal, 1)
+	signal.Notify(ch, os.Interrupt, syscall.SIGTERM)
+	<-ch
+	ws.stop()
+	os.Exit(1)
+}
+
+// start runs the harness of service s, the i-th one, with its output
+// prefixed by its name.
+func (ws *Workspace) start(s *Service, exe string, i int) error {
+	args := append([]string{"run"}, ws.BuildFlags...)
+	if LogLevel != "" {
+		args = append(args, "-log-level", LogLevel)
+	}
+	if ws.Debug {
+		port := ws.DebugPort
+		if port == 0 {
+			port = 2345
+		}
+		args = append(args, "-debug", "-debug-port", strconv.Itoa(port+i))
+	}
+	s.cmd = exec.Command(exe, append(args, s.Import, s.Mode, strconv.Itoa(s.Port))...)
+	s.cmd.Dir = s.Dir
+	s.cmd.Env = append(os.Environ(), "EGRET_SERVICE="+s.Name)
+	s.cmd.Stdout = newPrefixWriter(os.Stdout, s.Name)
+	s.cmd.Stderr = newPrefixWriter(os.Stderr, s.Name)
+	setProcessGroup(s.cmd)
+
+	ws.logger.Info("Starting service",
+		zap.String("service", s.Name),
+		zap.String("import_path", s.Import),
+		zap.String("mode", s.Mode),
+		zap.Int("port", s.Port))
+	if s.reserved != nil {
+		s.reserved.Close()
+		s.reserved = nil
+	}
+	if err := s.cmd.Start(); err != nil {
+		return err
+	}
+
+	s.done = make(chan struct{})
+	go func() {
+		err := s.cmd.Wait()
+		close(s.done)
+		ws.logger.Error("Service exited", zap.String("service", s.Name), zap.Error(err))
+	}()
+	return nil
+}
+
+// stop shuts every service down, killing those still running after a grace
+// period.
+func (ws *Workspace) stop() {
+	for _, s := range ws.Services {
+		if s.cmd != nil && s.cmd.Process != nil {
+			terminateProcess(s.cmd.Process)
+		}
+	}
+	deadline := time.Now().Add(5 * time.Second)
+	for _, s := range ws.Services {
+		if s.done == nil {
+			continue
+		}
+		select {
+		case <-s.done:
+		case <-time.After(time.Until(deadline)):
+			killProcessGroup(s.cmd.Process)
+		}
+	}
+}
+
+// ServeHTTP method forwards requests to the service they are routed to.
+func (ws *Workspace) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	s, prefix := ws.route(r)
+	if s == nil {
+		http.Error(w, fmt.Sprintf("No service of the workspace serves %s%s", r.Host, r.URL.Path), http.StatusNotFound)
+		return
+	}
+
+	if s.Strip && prefix != "" {
+		u := *r.URL
+		u.Path = "/" + strings.TrimLeft(strings.TrimPrefix(u.Path, prefix), "/")
+		u.RawPath = ""
+		r = r.WithContext(r.Context())
+		r.URL = &u
+	}
+
+	if strings.EqualFold(r.Header.Get("Upgrade"), "websocket") {
+		proxyWebsocket(w, r, s.scheme() == "https", s.host(), ws.logger)
+		return
+	}
+	s.proxy.ServeHTTP(w, r)
+}
+
+// route returns the service serving r, and the path prefix it matched.
+// Requests for the harness routes (live reload, dashboard) are routed by the
+// page they are made from, so that they reach the harness serving that page.
+func (ws *Workspace) route(r *http.Request) (*Service, string) {
+	host := r.Host
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+	host = strings.ToLower(host)
+
+	p, routedByPage := r.URL.Path, false
+	if isAdminPath(p) {
+		if ref, err := url.Parse(r.Referer()); err == nil && ref.Path != "" {
+			p, routedByPage = ref.Path, true
+		}
+	}
+
+	var best *Service
+	bestHost, bestPrefix := -1, ""
+	for _, s := range ws.Services {
+		if len(s.Hosts) == 0 && len(s.Paths) == 0 {
+			continue
+		}
+		hostScore := 0
+		if len(s.Hosts) > 0 {
+			if !s.matchHost(host) {
+				continue
+			}
+			hostScore = 1
+		}
+		prefix, ok := s.matchPath(p)
+		if !ok {
+			continue
+		}
+		if hostScore > bestHost || (hostScore == bestHost && len(prefix) > len(bestPrefix)) {
+			best, bestHost, bestPrefix = s, hostScore, prefix
+		}
+	}
+	if routedByPage {
+		// The harness routes are never stripped.
+		bestPrefix = ""
+	}
+	return best, bestPrefix
+}
+
+func (s *Service) matchHost(host string) bool {
+	for _, pattern := range s.Hosts {
+		if ok, _ := path.Match(strings.ToLower(pattern), host); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// matchPath returns the longest path prefix of s matching p.
+// Services without paths match any path with an empty prefix.
+func (s *Service) matchPath(p string) (string, bool) {
+	if len(s.Paths) == 0 {
+		return "", true
+	}
+	best, ok := "", false
+	for _, prefix := range s.Paths {
+		trimmed := strings.TrimSuffix(prefix, "/")
+		if p == trimmed || strings.HasPrefix(p, trimmed+"/") {
+			if !ok || len(trimmed) > len(best) {
+				best, ok = trimmed, true
+			}
+		}
+	}
+	return best, ok
+}
+
+// host returns the address of the service's harness.
+func (s *Service) host() string {
+	return fmt.Sprintf("localhost:%d", s.Port)
+}
+
+// scheme returns the scheme the service's harness is served with, which
+// depends on the app's TLS settings.  It is found by attempting a TLS
+// handshake, and again after a request fails, as the settings may change when
+// the app's configuration is reloaded.
+func (s *Service) scheme() string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.probed != "" {
+		return s.probed
+	}
+	conn, err := net.DialTimeout("tcp", s.host(), time.Second)
+	if err != nil {
+		// Not listening yet.
+		return "http"
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(time.Second))
+	s.probed = "http"
+	if tls.Client(conn, insecureTLSConfig()).Handshake() == nil {
+		s.probed = "https"
+	}
+	return s.probed
+}
+
+func (s *Service) director(req *http.Request) {
+	setProxyTarget(req, s.scheme(), s.host())
+}
+
+func (s *Service) proxyError(w http.ResponseWriter, r *http.Request, err error) {
+	s.mu.Lock()
+	s.probed = ""
+	s.mu.Unlock()
+	select {
+	case <-s.done:
+		http.Error(w, fmt.Sprintf("Service %s is not running, see the output of egret run.", s.Name), http.StatusBadGateway)
+	default:
+		http.Error(w, fmt.Sprintf("Service %s: %s", s.Name, err), http.StatusBadGateway)
+	}
+}
+
+// prefixWriter prefixes every line written to w with a name, e.g. of a service.
+type prefixWriter struct {
+	mu     sync.Mutex
+	w      io.Writer
+	prefix []byte
+	buf    []byte
+}
+
+func newPrefixWriter(w io.Writer, name string) *prefixWriter {
+	return &prefixWriter{w: w, prefix: []byte("[" + name + "] ")}
+}
+
+func (p *prefixWriter) Write(b []byte) (int, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.buf = append(p.buf, b...)
+	for {
+		i := bytes.IndexByte(p.buf, '\n')
+		if i < 0 {
+			break
+		}
+		line := append(append([]byte{}, p.prefix...), p.buf[:i+1]...)
+		if _, err := p.w.Write(line); err != nil {
+			return len(b), err
+		}
+		p.buf = p.buf[i+1:]
+	}
+	return len(b), nil
+}
+
+// Flush writes out the last line, if it wasn't terminated.
+func (p *prefixWriter) Flush() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if len(p.buf) > 0 {
+		p.w.Write(append(append(append([]byte{}, p.prefix...), p.buf...), '\n'))
+		p.buf = nil
+	}
+}